@@ -2,9 +2,11 @@ package client
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/gorilla/websocket"
 	"sanji_s12/commands"
+	"sanji_s12/config"
+	"sanji_s12/logger"
+	"sync"
 	"time"
 )
 
@@ -18,134 +20,126 @@ import (
 // 接收S10发送过来的指令 transfers11(针对s11) conn(xx-[yy,zz]) accept key s10告诉s12哪个设备将要连接s12
 //conn.WriteMessage()
 
-const s10URL = "ws://192.168.1.85:9910/?clienttype=s12"
-//const s10URL = "ws://127.0.0.1:7777/ws"
-
-var ErrorChan = make(chan struct{}, 1)
-
 // 封装与s10的连接
 type ClientConn struct {
 	ServerType string
 	LoginTime  int64 // 上线时间
 	OnlineTime int64 // 在线时间
 	Tm         int64 //最后一次通话的时间 毫秒
+	RTT        int64 // 最近一次心跳的往返时间 纳秒
 	Conn       *websocket.Conn
 	WsURL      string
-	CloseChan  chan struct{}
+	CloseChan  chan struct{} // 关闭后，这条连接的收发协程全部退出
+
+	conf     *config.Config
+	done     chan struct{} // 连接出错时关闭，通知Upstream重连
+	failOnce sync.Once
+	heard    int32 // 是否收到过s10的数据（包括pong），Upstream据此判断这条连接是否真的通了
 }
 
-func NewClientConn(conn *websocket.Conn, wsURL string) *ClientConn {
+func NewClientConn(conn *websocket.Conn, conf *config.Config) *ClientConn {
 	return &ClientConn{
 		ServerType: "s12",
 		Conn:       conn,
-		WsURL:      wsURL,
+		WsURL:      conf.S10URL,
 		LoginTime:  time.Now().Unix(),
-		//InCmdChan:  make(chan Cmd, 100),
-		//OutCmdChan: make(chan Cmd, 100),
-		CloseChan: make(chan struct{}, 1),
+		conf:       conf,
+		CloseChan:  make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
+// 连接出错，只有第一次调用生效
+func (c *ClientConn) fail(err error) {
+	c.failOnce.Do(func() {
+		logger.Warn("connection with s10 broken", logger.Err(err))
+		close(c.done)
+	})
+}
+
+// 连接出错时关闭的管道
+func (c *ClientConn) Done() <-chan struct{} {
+	return c.done
+}
+
 // 读取指令
+// 超过UpstreamPongWait没有收到s10的任何数据就认为连接已经断开，走断线重连
 func (c *ClientConn) ReadCommand() {
+	c.watchPong()
+
 	for {
 		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
-			fmt.Println("error while reading command: " + err.Error())
-			// 断线重连
-			c.Conn.Close()
-			ErrorChan <- struct{}{}
-			break
+			c.fail(err)
+			return
 		}
+		c.alive()
+		c.hear()
 		// 反序列化这条指令，把它放到指令管道中
-		fmt.Println("reading bytes: ", string(data))
+		logger.Debug("command received", logger.Payload(data))
 		cmd := commands.Cmd{}
 		if len(data) > 0 {
 			err = json.Unmarshal(data, &cmd)
 			if err != nil {
-				fmt.Println("error while decoding cmd: ", err.Error())
+				logger.Warn("can't decode command", logger.Err(err))
 				continue
 			}
 
-			commands.InCmdChan <- cmd
+			select {
+			case commands.InCmdChan <- cmd:
+			case <-c.CloseChan:
+				return
+			}
 		}
 	}
 }
 
 // 发送指令
+// 先把队列中积压的指令（包括上一条连接没发出去的）按顺序发完，再等新的指令
 func (c *ClientConn) SendCommand() {
+	queue := commands.OutCmdQueue
 	for {
-		select {
-		case cmd := <-commands.OutCmdChan:
-			jsonValue, err := json.Marshal(cmd)
-			if err != nil {
-				fmt.Println(err.Error())
-				continue
-			}
-			fmt.Println("get data from outCmdChan: " + string(jsonValue))
-			err = c.Conn.WriteMessage(websocket.TextMessage, jsonValue)
-			if err != nil {
-				fmt.Println("error while sending command: ", err.Error())
+		for item := queue.Peek(); item != nil; item = queue.Peek() {
+			if err := c.WriteCommand(item.Cmd); err != nil {
+				// 指令留在队列中，重连后再发
 				// 断线重连
-				ErrorChan <- struct{}{}
+				c.fail(err)
+				return
 			}
-		case <-c.CloseChan:
-			return
-		}
-	}
-}
+			queue.Remove(item)
 
-
-// 断线重连
-// (长时间没有数据发送的长连接容易被浏览器、移动中间商、nginx、服务端程序断开)
-func Reconnect() {
-	for {
-		select {
-		case <-ErrorChan:
-			fmt.Println("断线重连中。。。")
-			time.Sleep(5 * time.Second)
-			var dialer *websocket.Dialer
-			conn, _, err := dialer.Dial(s10URL, nil)
-			if err != nil {
-				ErrorChan <- struct{}{}
-				continue
+			select {
+			case <-c.CloseChan:
+				return
+			default:
 			}
-			connection := NewClientConn(conn, s10URL)
-
-			go connection.SendCommand()
-			go connection.ReadCommand()
-
+		}
 
+		select {
+		case <-queue.Ready():
+		case <-c.CloseChan:
+			return
 		}
 	}
 }
 
-// s12启动后作为客户端的主入口
-func WSClient() {
-
-	// 建立与s10的websocket通信
-	var dialer *websocket.Dialer
-	conn, _, err := dialer.Dial(s10URL, nil)
+// 向s10写一条指令
+func (c *ClientConn) WriteCommand(cmd commands.Cmd) error {
+	jsonValue, err := json.Marshal(cmd)
 	if err != nil {
-		fmt.Println("error while connect s10 in the first time: ", err)
-		ErrorChan <- struct{}{}
-		// 断线重连
-		go Reconnect()
-		return
+		return err
 	}
+	logger.Debug("sending command", logger.Cmd(cmd.Cmd), logger.CmdId(cmd.CmdId), logger.Payload(jsonValue))
+	c.Conn.SetWriteDeadline(time.Now().Add(c.conf.WriteWait.Duration))
+	return c.Conn.WriteMessage(websocket.TextMessage, jsonValue)
+}
 
-	fmt.Println("Establish connection with s10")
-	connection := NewClientConn(conn, s10URL)
-	connection.LoginTime = time.Now().Unix()
-
-	// 这里是发消息的协程，向S10发送report指令
-	go connection.SendCommand()
-
-	// 读取S10下发的指令协程
-	go connection.ReadCommand()
-
-	// 断线重连
-	go Reconnect()
-
-
+// s12启动后作为客户端的主入口
+// 连接s10，断线后自动重连
+// onConnect 返回每次连上s10之后需要马上上报的指令
+func WSClient(conf *config.Config, onConnect func() []commands.Cmd) *Upstream {
+	upstream := NewUpstream(conf)
+	upstream.OnConnect = onConnect
+	go upstream.Run()
+	return upstream
 }
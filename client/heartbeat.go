@@ -0,0 +1,70 @@
+package client
+
+import (
+	"sanji_s12/logger"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 定时向s10发送ping，ping里带上发送时间，收到pong后计算往返时间
+// ping发送失败时触发断线重连
+func (c *ClientConn) Heartbeat() {
+	ticker := time.NewTicker(c.conf.UpstreamPingInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+			deadline := time.Now().Add(c.conf.WriteWait.Duration)
+			if err := c.Conn.WriteControl(websocket.PingMessage, []byte(payload), deadline); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.CloseChan:
+			return
+		}
+	}
+}
+
+// 设置读超时以及pong的处理
+func (c *ClientConn) watchPong() {
+	c.alive()
+	c.Conn.SetPongHandler(func(payload string) error {
+		if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			rtt := time.Duration(time.Now().UnixNano() - sent)
+			atomic.StoreInt64(&c.RTT, int64(rtt))
+			logger.Debug("pong from s10", logger.F("rtt", rtt.String()))
+		}
+		c.alive()
+		c.hear()
+		return nil
+	})
+}
+
+// 记录收到了s10的数据
+func (c *ClientConn) hear() {
+	atomic.StoreInt32(&c.heard, 1)
+}
+
+// 是否收到过s10的数据
+func (c *ClientConn) Heard() bool {
+	return atomic.LoadInt32(&c.heard) == 1
+}
+
+// 收到s10的数据，说明连接还活着
+// 更新最后通话时间、在线时长，并延长读超时
+func (c *ClientConn) alive() {
+	now := time.Now()
+	atomic.StoreInt64(&c.Tm, now.UnixNano()/int64(time.Millisecond))
+	atomic.StoreInt64(&c.OnlineTime, now.Unix()-c.LoginTime)
+	c.Conn.SetReadDeadline(now.Add(c.conf.UpstreamPongWait.Duration))
+}
+
+// 最近一次心跳的往返时间
+func (c *ClientConn) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.RTT))
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"sanji_s12/logger"
+	"sanji_s12/metrics"
+	"sanji_s12/util"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 与s10的连接管理
+// 断线重连
+// (长时间没有数据发送的长连接容易被浏览器、移动中间商、nginx、服务端程序断开)
+// 同一时间只保留一条与s10的连接，旧连接的收发协程全部退出之后才会重连
+// 重连间隔按指数增长并加上随机抖动，最长不超过ReconnectMaxDelay
+type Upstream struct {
+	conf *config.Config
+
+	// 每次连上s10之后，跟在hello指令后面发送的指令，比如当前状态的report
+	OnConnect func() []commands.Cmd
+
+	lock    sync.Mutex
+	current *ClientConn
+
+	attempts   int64 // 拨号次数
+	failures   int64 // 拨号失败次数
+	reconnects int64 // 断线后重新连上的次数
+	lastError  atomic.Value
+	jitter     *rand.Rand // 只在Run协程中使用
+
+	stop     chan struct{} // 关闭后不再重连
+	stopOnce sync.Once
+}
+
+// 重连统计
+type Stats struct {
+	Connected  bool          `json:"connected"`
+	Attempts   int64         `json:"attempts"`
+	Failures   int64         `json:"failures"`
+	Reconnects int64         `json:"reconnects"`
+	LastError  string        `json:"last_error"`
+	RTT        time.Duration `json:"rtt"`         // 最近一次心跳的往返时间 纳秒，没有连接时为0
+	OnlineTime int64         `json:"online_time"` // 当前连接的在线时长 秒
+}
+
+func NewUpstream(conf *config.Config) *Upstream {
+	return &Upstream{
+		conf:   conf,
+		jitter: rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:   make(chan struct{}),
+	}
+}
+
+// 连接s10，连接断开后重连，直到调用Shutdown
+func (u *Upstream) Run() {
+	retry := 0
+	connected := false
+	for {
+		select {
+		case <-u.stop:
+			return
+		default:
+		}
+
+		conn, err := u.dial()
+		if err != nil {
+			delay := u.backoff(retry)
+			retry++
+			logger.Warn("can't connect s10", logger.Err(err), logger.F("retry", retry), logger.F("delay", delay.String()))
+			select {
+			case <-time.After(delay):
+			case <-u.stop:
+				return
+			}
+			continue
+		}
+
+		if connected {
+			atomic.AddInt64(&u.reconnects, 1)
+		}
+		connected = true
+
+		logger.Info("connected to s10", logger.F("reconnects", atomic.LoadInt64(&u.reconnects)))
+		u.serve(conn)
+
+		// 拨号成功不代表连接可用：s10可能接受连接后马上断开，或者握手就写失败了
+		// 只有收到过s10的数据才重置退避，否则每次重连前都按退避等待，避免疯狂重连
+		if conn.Heard() {
+			retry = 0
+		}
+		delay := u.backoff(retry)
+		retry++
+		logger.Info("reconnecting to s10", logger.F("retry", retry), logger.F("delay", delay.String()))
+		select {
+		case <-time.After(delay):
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// 停止与s10的连接
+// 先等队列中的指令发完（ctx超时则不再等），再发送关闭帧断开连接，之后不再重连
+func (u *Upstream) Shutdown(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+wait:
+	for commands.OutCmdQueue.Len() > 0 && u.Current() != nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Warn("commands not sent to s10", logger.F("count", commands.OutCmdQueue.Len()))
+			break wait
+		}
+	}
+
+	u.stopOnce.Do(func() {
+		close(u.stop)
+	})
+
+	if conn := u.Current(); conn != nil {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "s12 shutdown")
+		conn.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(u.conf.WriteWait.Duration))
+		conn.fail(errors.New("shutdown"))
+	}
+}
+
+func (u *Upstream) dial() (*ClientConn, error) {
+	atomic.AddInt64(&u.attempts, 1)
+	var dialer *websocket.Dialer
+	conn, _, err := dialer.Dial(u.conf.S10URL, nil)
+	if err != nil {
+		atomic.AddInt64(&u.failures, 1)
+		u.lastError.Store(err.Error())
+		return nil, err
+	}
+	return NewClientConn(conn, u.conf), nil
+}
+
+// 开启这条连接的收发协程，直到连接出错
+// 返回前关闭连接并等待所有协程退出
+func (u *Upstream) serve(conn *ClientConn) {
+	if err := u.handshake(conn); err != nil {
+		logger.Warn("handshake with s10 failed", logger.Err(err))
+		conn.Conn.Close()
+		return
+	}
+
+	u.lock.Lock()
+	u.current = conn
+	u.lock.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	// 这里是发消息的协程，向S10发送report指令
+	go func() {
+		defer wg.Done()
+		conn.SendCommand()
+	}()
+	// 读取S10下发的指令协程
+	go func() {
+		defer wg.Done()
+		conn.ReadCommand()
+	}()
+	// 心跳协程
+	go func() {
+		defer wg.Done()
+		conn.Heartbeat()
+	}()
+
+	<-conn.Done()
+	close(conn.CloseChan)
+	conn.Conn.Close()
+	wg.Wait()
+
+	u.lock.Lock()
+	u.current = nil
+	u.lock.Unlock()
+}
+
+// 连上s10后先告诉s10自己是谁，再上报当前的状态
+// 这些指令直接写到连接上，保证在其它排队的指令之前发出
+// 断线期间排队的report比这份状态旧，在生成状态之前丢掉；之后排队的report照常补发
+func (u *Upstream) handshake(conn *ClientConn) error {
+	hello := commands.Cmd{
+		CmdId: util.GetCmdId(),
+		Cmd:   "hello",
+		Role:  "client",
+		Data:  commands.GetS12Key(),
+	}
+	if err := conn.WriteCommand(hello); err != nil {
+		return err
+	}
+
+	if u.OnConnect == nil {
+		return nil
+	}
+	if dropped := commands.OutCmdQueue.DropReports(); dropped > 0 {
+		logger.Info("queued reports replaced by the current state", logger.F("count", dropped))
+	}
+	for _, cmd := range u.OnConnect() {
+		if err := conn.WriteCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 第retry次重连前等待的时间
+// ReconnectDelay * 2^retry，不超过ReconnectMaxDelay，再在[delay/2, delay]之间随机取值
+func (u *Upstream) backoff(retry int) time.Duration {
+	delay := u.conf.ReconnectDelay.Duration
+	max := u.conf.ReconnectMaxDelay.Duration
+	for i := 0; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + u.jitter.Int63n(half+1))
+}
+
+// 当前与s10的连接，没有连接时返回nil
+func (u *Upstream) Current() *ClientConn {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.current
+}
+
+// 重连统计
+func (u *Upstream) Stats() Stats {
+	stats := Stats{
+		Connected:  u.Current() != nil,
+		Attempts:   atomic.LoadInt64(&u.attempts),
+		Failures:   atomic.LoadInt64(&u.failures),
+		Reconnects: atomic.LoadInt64(&u.reconnects),
+	}
+	if lastError, ok := u.lastError.Load().(string); ok {
+		stats.LastError = lastError
+	}
+	if conn := u.Current(); conn != nil {
+		stats.RTT = conn.Latency()
+		stats.OnlineTime = atomic.LoadInt64(&conn.OnlineTime)
+	}
+	return stats
+}
+
+// 与s10连接的指标
+func (u *Upstream) Collect(w *metrics.Writer) {
+	stats := u.Stats()
+	connected := 0.0
+	if stats.Connected {
+		connected = 1
+	}
+	w.Single("s12_upstream_connected", "Whether s12 is connected to s10.", metrics.TypeGauge, connected)
+	w.Single("s12_upstream_dials_total", "Attempts to connect to s10.", metrics.TypeCounter, float64(stats.Attempts))
+	w.Single("s12_upstream_dial_failures_total", "Failed attempts to connect to s10.", metrics.TypeCounter, float64(stats.Failures))
+	w.Single("s12_upstream_reconnects_total", "Times s12 connected to s10 again after losing the connection.", metrics.TypeCounter, float64(stats.Reconnects))
+	w.Single("s12_upstream_rtt_seconds", "Round trip time of the last heartbeat to s10, 0 while disconnected.", metrics.TypeGauge, stats.RTT.Seconds())
+	w.Single("s12_upstream_online_seconds", "How long the current connection to s10 has been up.", metrics.TypeGauge, float64(stats.OnlineTime))
+}
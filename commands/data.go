@@ -4,10 +4,15 @@ package commands
 var S12Key string
 var PermissionKey []string
 
+var InCmdChan = make(chan Cmd, 100)                      // 放置指令的管道
+var OutCmdQueue = NewOutQueue(100, DropOldest, true, "") // 发给s10的指令队列
 
-
-var InCmdChan = make(chan Cmd, 100) // 放置指令的管道
-var OutCmdChan = make(chan Cmd, 1)  // 读取指令的管道
+// 按配置重新创建指令管道和队列
+// 必须在收发指令的协程启动之前调用
+func InitChans(inBuffer int, outQueue *OutQueue) {
+	InCmdChan = make(chan Cmd, inBuffer)
+	OutCmdQueue = outQueue
+}
 
 // 首先确定数据结构
 // websocket 发送的指令数据格式
@@ -20,9 +25,21 @@ type Cmd struct {
 	From        string `json:"from"` // 从 from 过来的数据
 	To          string `json:"to"`   // 发给 To
 	Rtmp        string `json:"rtmp"`
-	File        string `json:"file"` //如果有File值就要保存文件，此指令不中断之前的操作。
-	Data        string `json:"data"` //
-	FromConnKey string               // 发送方的连接，这个字段自用
+	File        string `json:"file"`                  //如果有File值就要保存文件，此指令不中断之前的操作。
+	Data        string `json:"data"`                  //
+	MsgType     string `json:"msgtype,omitempty"`     // conn指令使用，强制以text或binary转发，为空则保持原样；notify指令使用，为空时以text发送
+	DeviceType  string `json:"devicetype,omitempty"`  // notify指令使用，只发给这一类设备，为空表示所有设备
+	Persist     bool   `json:"persist,omitempty"`     // conn指令使用，设备下线后保留这条路由，重新上线时自动接上
+	Envelope    bool   `json:"envelope,omitempty"`    // conn指令使用，转发的每帧数据都带上发送方的key
+	Duplex      bool   `json:"duplex,omitempty"`      // conn指令使用，同时建立to到from的路由，两个方向一起断开
+	BroadcastId string `json:"broadcastid,omitempty"` // broadcast系列指令使用，广播的id
+	Timeout     int64  `json:"timeout,omitempty"`     // broadcast、extendbroadcast指令使用，广播持续的秒数
+	FromConnKey string // 发送方的连接，这个字段自用
+
+	// 以下字段只在回复s10的ack指令中使用
+	Ack  string `json:"ack,omitempty"` // 回复的是哪条指令
+	Code int    `json:"code"`          // 执行结果，0表示成功，见 reply.go
+	Msg  string `json:"msg,omitempty"` // 执行失败的原因
 }
 
 type ReportData struct {
@@ -35,6 +52,8 @@ type ConnectStatus struct {
 	State      string                 `json:"state"`
 	Clients    map[string]interface{} `json:"clients"`
 	Routers    map[string][]string    `json:"routers"`
+	Duplex     map[string][]string    `json:"duplex,omitempty"`     // routers中哪些路由是双向的
+	Broadcasts interface{}            `json:"broadcasts,omitempty"` // 正在进行的广播
 	WhiteList  []string               `json:"white_list"`
 	Active     int64                  `json:"active"`
 	ServerInfo interface{}            `json:"server_info"`
@@ -0,0 +1,72 @@
+package commands
+
+import "sync"
+
+// 保护PermissionKey，s10的accept指令、管理接口和设备连接会同时读写它
+var permissionLock sync.RWMutex
+
+// 允许这个key连接，已经在列表中时不重复添加
+func AllowKey(key string) {
+	permissionLock.Lock()
+	defer permissionLock.Unlock()
+
+	for _, value := range PermissionKey {
+		if value == key {
+			return
+		}
+	}
+	PermissionKey = append(PermissionKey, key)
+}
+
+// 不再允许这个key连接，已经在线的设备不受影响
+// 返回这个key原来是否在列表中
+func RevokeKey(key string) bool {
+	permissionLock.Lock()
+	defer permissionLock.Unlock()
+
+	for index, value := range PermissionKey {
+		if value == key {
+			PermissionKey = append(PermissionKey[:index:index], PermissionKey[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 这个key是否允许连接
+func KeyAllowed(key string) bool {
+	permissionLock.RLock()
+	defer permissionLock.RUnlock()
+
+	for _, value := range PermissionKey {
+		if value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// 允许连接的key，返回的是拷贝
+func AllowedKeys() []string {
+	permissionLock.RLock()
+	defer permissionLock.RUnlock()
+
+	return append([]string{}, PermissionKey...)
+}
+
+// 保护S12Key，s10的set指令写它，与s10握手和打印状态时读它
+var s12KeyLock sync.RWMutex
+
+func SetS12Key(key string) {
+	s12KeyLock.Lock()
+	defer s12KeyLock.Unlock()
+
+	S12Key = key
+}
+
+func GetS12Key() string {
+	s12KeyLock.RLock()
+	defer s12KeyLock.RUnlock()
+
+	return S12Key
+}
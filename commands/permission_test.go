@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// go test -race 检查set指令、与s10握手、管理接口同时读写时没有数据竞争
+func TestConcurrentKeys(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+				SetS12Key(key)
+				AllowKey(key)
+				RevokeKey(key)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				GetS12Key()
+				KeyAllowed("0")
+				AllowedKeys()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if keys := AllowedKeys(); len(keys) != 0 {
+		t.Errorf("AllowedKeys() = %v after every key was revoked", keys)
+	}
+}
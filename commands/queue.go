@@ -0,0 +1,239 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sanji_s12/logger"
+	"sync"
+	"sync/atomic"
+)
+
+// 发给s10的指令队列满了之后的处理方式
+const (
+	DropOldest = "drop-oldest" // 丢掉最早的指令
+	DropNewest = "drop-newest" // 丢掉新来的指令
+)
+
+// 队列中的一条指令
+// Snapshot为true表示这是若干条report合并之后的占位，发送时才生成一份当前状态的report
+type QueueItem struct {
+	Cmd      Cmd  `json:"cmd"`
+	Snapshot bool `json:"snapshot,omitempty"`
+}
+
+// 发给s10的指令队列
+// s10断线的时候指令留在队列中，重连后按顺序补发
+// 队列有长度上限，满了按Policy丢弃；开启Coalesce时，多条还没发出去的report合并成一份当前状态
+// File不为空时，队列内容同步写到这个文件，s12重启后继续发送
+type OutQueue struct {
+	lock     sync.Mutex
+	items    []*QueueItem
+	size     int
+	policy   string
+	coalesce bool
+	file     string
+	ready    chan struct{}
+	dropped  int64
+
+	// 生成一份当前状态的report，合并report时使用
+	Snapshot func() (Cmd, error)
+}
+
+func NewOutQueue(size int, policy string, coalesce bool, file string) *OutQueue {
+	q := &OutQueue{
+		size:     size,
+		policy:   policy,
+		coalesce: coalesce,
+		file:     file,
+		ready:    make(chan struct{}, 1),
+	}
+	if file != "" {
+		q.load()
+	}
+	return q
+}
+
+// 放入一条指令，不会阻塞
+func (q *OutQueue) Push(cmd Cmd) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.merge(cmd) {
+		q.items = append(q.items, &QueueItem{Cmd: cmd})
+	}
+	for len(q.items) > q.size {
+		atomic.AddInt64(&q.dropped, 1)
+		if q.policy == DropNewest {
+			q.items = q.items[:len(q.items)-1]
+		} else {
+			q.items = q.items[1:]
+		}
+	}
+	q.save()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// 把新的report与队列中还没发出去的report合并
+// 合并后只保留一个占位，放在最早那条report的位置上
+func (q *OutQueue) merge(cmd Cmd) bool {
+	if !q.coalesce || cmd.Cmd != "report" || q.Snapshot == nil {
+		return false
+	}
+
+	first := -1
+	kept := q.items[:0]
+	for _, item := range q.items {
+		if item.Snapshot || item.Cmd.Cmd == "report" {
+			if first < 0 {
+				first = len(kept)
+				kept = append(kept, &QueueItem{Snapshot: true})
+			}
+			continue
+		}
+		kept = append(kept, item)
+	}
+	q.items = kept
+	return first >= 0
+}
+
+// 队列头部的指令，队列为空时返回nil
+// 发送成功后调用Remove把它从队列中删除，发送失败则留在队列中等重连后再发
+func (q *OutQueue) Peek() *QueueItem {
+	for {
+		q.lock.Lock()
+		if len(q.items) == 0 {
+			q.lock.Unlock()
+			return nil
+		}
+		item := q.items[0]
+		q.lock.Unlock()
+
+		if !item.Snapshot {
+			return item
+		}
+
+		// 生成report时不持有队列的锁
+		cmd, err := q.snapshot()
+
+		q.lock.Lock()
+		// 这期间队列头部可能已经变了
+		if len(q.items) > 0 && q.items[0] == item {
+			if err != nil {
+				logger.Error("can't create snapshot report", logger.Err(err))
+				q.items = q.items[1:]
+			} else {
+				q.items[0] = &QueueItem{Cmd: cmd}
+			}
+			q.save()
+		}
+		q.lock.Unlock()
+	}
+}
+
+func (q *OutQueue) snapshot() (Cmd, error) {
+	if q.Snapshot == nil {
+		return Cmd{}, errors.New("no snapshot function")
+	}
+	return q.Snapshot()
+}
+
+// 删除已经发出去的指令
+func (q *OutQueue) Remove(item *QueueItem) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for index, value := range q.items {
+		if value == item {
+			q.items = append(q.items[:index:index], q.items[index+1:]...)
+			q.save()
+			return
+		}
+	}
+}
+
+// 删除所有还没发出去的report，包括合并的占位，返回删除的条数
+// 马上要向s10发送一份完整的当前状态，之前排队的report都过时了，补发只会让s10退回到旧的状态
+func (q *OutQueue) DropReports() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	kept := make([]*QueueItem, 0, len(q.items))
+	for _, item := range q.items {
+		if !item.Snapshot && item.Cmd.Cmd != "report" {
+			kept = append(kept, item)
+		}
+	}
+	dropped := len(q.items) - len(kept)
+	if dropped > 0 {
+		q.items = kept
+		q.save()
+	}
+	return dropped
+}
+
+// 有新指令放入时会收到通知
+func (q *OutQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// 队列中的指令数
+func (q *OutQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.items)
+}
+
+// 因为队列满了而丢掉的指令数
+func (q *OutQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// 把队列写到文件中，先写临时文件再改名，避免写到一半时文件损坏
+// 每次Push、Remove都在持有锁的情况下重写整个文件，开销与队列长度成正比：
+// 队列最长OutQueueSize条，默认1000条时每次几十KB；s10断线积压时写文件会拖慢Push，
+// 指令量大的场景应该调小out_queue_size或者不开启持久化
+func (q *OutQueue) save() {
+	if q.file == "" {
+		return
+	}
+	data, err := json.Marshal(q.items)
+	if err != nil {
+		logger.Error("can't encode out queue", logger.Err(err))
+		return
+	}
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		logger.Error("can't save out queue", logger.F("file", tmp), logger.Err(err))
+		return
+	}
+	if err := os.Rename(tmp, q.file); err != nil {
+		logger.Error("can't save out queue", logger.F("file", q.file), logger.Err(err))
+	}
+}
+
+func (q *OutQueue) load() {
+	data, err := ioutil.ReadFile(q.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("can't load out queue", logger.F("file", q.file), logger.Err(err))
+		}
+		return
+	}
+	var items []*QueueItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		logger.Error("can't decode out queue", logger.F("file", q.file), logger.Err(err))
+		return
+	}
+	if len(items) > q.size {
+		items = items[len(items)-q.size:]
+	}
+	q.items = items
+	logger.Info("out queue loaded", logger.F("file", q.file), logger.F("count", len(items)))
+}
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 队列中每条指令的CmdId，合并report的占位记为0
+func queueIds(q *OutQueue) []int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ids := []int64{}
+	for _, item := range q.items {
+		if item.Snapshot {
+			ids = append(ids, 0)
+		} else {
+			ids = append(ids, item.Cmd.CmdId)
+		}
+	}
+	return ids
+}
+
+// 依次Peek并Remove，返回发送的顺序
+func drain(q *OutQueue) []int64 {
+	ids := []int64{}
+	for item := q.Peek(); item != nil; item = q.Peek() {
+		ids = append(ids, item.Cmd.CmdId)
+		q.Remove(item)
+	}
+	return ids
+}
+
+func cmd(id int64) Cmd    { return Cmd{CmdId: id, Cmd: "conn"} }
+func report(id int64) Cmd { return Cmd{CmdId: id, Cmd: "report"} }
+
+func TestOutQueuePush(t *testing.T) {
+	snapshot := func() (Cmd, error) { return report(100), nil }
+
+	tests := []struct {
+		name     string
+		size     int
+		policy   string
+		coalesce bool
+		snapshot func() (Cmd, error)
+		push     []Cmd
+		queued   []int64 // Push之后队列中的内容
+		sent     []int64 // 依次Peek、Remove得到的顺序
+		dropped  int64
+	}{
+		{
+			name:    "drop oldest",
+			size:    3,
+			policy:  DropOldest,
+			push:    []Cmd{cmd(1), cmd(2), cmd(3), cmd(4), cmd(5)},
+			queued:  []int64{3, 4, 5},
+			sent:    []int64{3, 4, 5},
+			dropped: 2,
+		},
+		{
+			name:    "drop newest",
+			size:    3,
+			policy:  DropNewest,
+			push:    []Cmd{cmd(1), cmd(2), cmd(3), cmd(4), cmd(5)},
+			queued:  []int64{1, 2, 3},
+			sent:    []int64{1, 2, 3},
+			dropped: 2,
+		},
+		{
+			name:     "coalesce reports into the first report's place",
+			size:     10,
+			policy:   DropOldest,
+			coalesce: true,
+			snapshot: snapshot,
+			push:     []Cmd{cmd(1), report(2), cmd(3), report(4), cmd(5), report(6)},
+			queued:   []int64{1, 0, 3, 5},
+			sent:     []int64{1, 100, 3, 5},
+		},
+		{
+			name:     "a single report is not replaced",
+			size:     10,
+			policy:   DropOldest,
+			coalesce: true,
+			snapshot: snapshot,
+			push:     []Cmd{cmd(1), report(2), cmd(3)},
+			queued:   []int64{1, 2, 3},
+			sent:     []int64{1, 2, 3},
+		},
+		{
+			name:   "coalesce disabled",
+			size:   10,
+			policy: DropOldest,
+			push:   []Cmd{report(1), report(2), cmd(3)},
+			queued: []int64{1, 2, 3},
+			sent:   []int64{1, 2, 3},
+		},
+		{
+			name:     "coalesce without a snapshot function",
+			size:     10,
+			policy:   DropOldest,
+			coalesce: true,
+			push:     []Cmd{report(1), report(2)},
+			queued:   []int64{1, 2},
+			sent:     []int64{1, 2},
+		},
+		{
+			name:     "failed snapshot is skipped",
+			size:     10,
+			policy:   DropOldest,
+			coalesce: true,
+			snapshot: func() (Cmd, error) { return Cmd{}, errors.New("boom") },
+			push:     []Cmd{report(1), report(2), cmd(3)},
+			queued:   []int64{0, 3},
+			sent:     []int64{3},
+		},
+		{
+			name:     "placeholder is dropped like any other command",
+			size:     2,
+			policy:   DropOldest,
+			coalesce: true,
+			snapshot: snapshot,
+			push:     []Cmd{report(1), report(2), cmd(3), cmd(4)},
+			queued:   []int64{3, 4},
+			sent:     []int64{3, 4},
+			dropped:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewOutQueue(tt.size, tt.policy, tt.coalesce, "")
+			q.Snapshot = tt.snapshot
+			for _, c := range tt.push {
+				q.Push(c)
+			}
+			if got := queueIds(q); !reflect.DeepEqual(got, tt.queued) {
+				t.Errorf("queued = %v, want %v", got, tt.queued)
+			}
+			if got := q.Dropped(); got != tt.dropped {
+				t.Errorf("Dropped() = %d, want %d", got, tt.dropped)
+			}
+			if got := drain(q); !reflect.DeepEqual(got, tt.sent) {
+				t.Errorf("sent = %v, want %v", got, tt.sent)
+			}
+			if q.Len() != 0 {
+				t.Errorf("Len() = %d after draining", q.Len())
+			}
+		})
+	}
+}
+
+// Remove只删除发出去的那一条，其余的顺序不变
+func TestOutQueueRemove(t *testing.T) {
+	q := NewOutQueue(10, DropOldest, false, "")
+	for id := int64(1); id <= 3; id++ {
+		q.Push(cmd(id))
+	}
+	head := q.Peek()
+	q.Push(cmd(4))
+
+	q.lock.Lock()
+	middle := q.items[2]
+	q.lock.Unlock()
+	q.Remove(middle)
+	q.Remove(head)
+	q.Remove(head) // 重复删除没有影响
+
+	if got, want := queueIds(q), []int64{2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued = %v, want %v", got, want)
+	}
+}
+
+func TestOutQueueFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "queue.json")
+
+	q := NewOutQueue(10, DropOldest, true, file)
+	q.Snapshot = func() (Cmd, error) { return report(100), nil }
+	for _, c := range []Cmd{cmd(1), report(2), report(3), cmd(4), cmd(5)} {
+		q.Push(c)
+	}
+	q.Remove(q.Peek())
+
+	// 占位也要保存下来，重启后发送时再生成report
+	loaded := NewOutQueue(10, DropOldest, true, file)
+	if got, want := queueIds(loaded), []int64{0, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded = %v, want %v", got, want)
+	}
+	loaded.Snapshot = q.Snapshot
+	if got, want := drain(loaded), []int64{100, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent = %v, want %v", got, want)
+	}
+
+	// 发完之后文件中也是空的
+	if got := queueIds(NewOutQueue(10, DropOldest, true, file)); len(got) != 0 {
+		t.Errorf("loaded = %v after draining, want empty", got)
+	}
+
+	// 配置的长度变小了，只保留最新的几条
+	for _, c := range []Cmd{cmd(6), cmd(7)} {
+		q.Push(c)
+	}
+	if got, want := queueIds(NewOutQueue(1, DropOldest, false, file)), []int64{7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded into a shorter queue = %v, want %v", got, want)
+	}
+}
+
+// 重连后先发一份当前状态，排队的report和占位都丢掉，其余指令保持顺序
+func TestOutQueueDropReports(t *testing.T) {
+	// 开启合并时两条report已经合并成了一个占位
+	for coalesce, reports := range map[bool]int{false: 2, true: 1} {
+		q := NewOutQueue(10, DropOldest, coalesce, "")
+		q.Snapshot = func() (Cmd, error) { return report(100), nil }
+		for _, c := range []Cmd{cmd(1), report(2), cmd(3), report(4), cmd(5)} {
+			q.Push(c)
+		}
+
+		if got := q.DropReports(); got != reports {
+			t.Errorf("coalesce=%v: DropReports() = %d, want %d", coalesce, got, reports)
+		}
+		if got, want := drain(q), []int64{1, 3, 5}; !reflect.DeepEqual(got, want) {
+			t.Errorf("coalesce=%v: sent = %v, want %v", coalesce, got, want)
+		}
+		if got := q.DropReports(); got != 0 {
+			t.Errorf("coalesce=%v: DropReports() on a queue without reports = %d", coalesce, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package commands
+
+import "fmt"
+
+// 指令执行结果的状态码
+const (
+	CodeOK               = 0    // 执行成功
+	CodeUnknownCmd       = 1001 // 不认识的指令
+	CodeBadData          = 1002 // 指令的字段格式不对
+	CodeDeviceUnknown    = 1003 // 设备不在线
+	CodeRouteExists      = 1004 // 路由已经存在
+	CodeRouteUnknown     = 1005 // 路由不存在
+	CodeBroadcastExists  = 1006 // 广播已经存在，或者设备已经在广播
+	CodeBroadcastUnknown = 1007 // 广播不存在
+	CodeKeyUnknown       = 1008 // key不在允许连接的列表中
+	CodeInternal         = 1500 // s12内部错误
+)
+
+// 指令执行失败的原因，带上返回给s10的状态码
+type CmdError struct {
+	Code int
+	Msg  string
+}
+
+func (e *CmdError) Error() string {
+	return fmt.Sprintf("code %d: %s", e.Code, e.Msg)
+}
+
+func Errorf(code int, format string, args ...interface{}) *CmdError {
+	return &CmdError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// 执行失败的状态码和原因，不是CmdError的错误都算作s12内部错误
+func ErrorCode(err error) (int, string) {
+	if err == nil {
+		return CodeOK, ""
+	}
+	if cmdErr, ok := err.(*CmdError); ok {
+		return cmdErr.Code, cmdErr.Msg
+	}
+	return CodeInternal, err.Error()
+}
+
+// 根据执行结果生成回复s10的ack指令
+// 回复的CmdId与收到的指令相同，s10据此把回复和指令对应起来
+func Reply(cmd Cmd, err error) Cmd {
+	reply := Cmd{
+		CmdId: cmd.CmdId,
+		Cmd:   "ack",
+		Role:  "client",
+		From:  cmd.From,
+		To:    cmd.To,
+		Ack:   cmd.Cmd,
+	}
+	reply.Code, reply.Msg = ErrorCode(err)
+	return reply
+}
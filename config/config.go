@@ -0,0 +1,407 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sanji_s12/commands"
+	"sanji_s12/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S12 的运行配置
+// 配置来源的优先级（从低到高）：默认值 < 配置文件 < 环境变量 < 命令行参数
+// 配置文件为json格式，通过 -config 参数或 S12_CONFIG 环境变量指定
+type Config struct {
+	S10URL               string            `json:"s10_url"`                // 上游s10的地址
+	ListenAddr           string            `json:"listen_addr"`            // 监听设备连接的地址
+	WSPath               string            `json:"ws_path"`                // 设备连接的websocket路径
+	MetricsPath          string            `json:"metrics_path"`           // Prometheus指标的路径，为空则不开启
+	MetricsRedact        bool              `json:"metrics_redact"`         // 指标的label中是否用设备key的哈希代替key本身
+	AdminPath            string            `json:"admin_path"`             // 管理接口的路径前缀，以/结尾
+	AdminToken           string            `json:"admin_token"`            // 管理接口的令牌，为空则不开启管理接口
+	ReconnectDelay       Duration          `json:"reconnect_delay"`        // 与s10断线后第一次重连的间隔，之后按指数增长
+	ReconnectMaxDelay    Duration          `json:"reconnect_max_delay"`    // 重连间隔的上限
+	PendingRouteTimeout  Duration          `json:"pending_route_timeout"`  // 路由等待设备上线的超时，超时后上报s10，0表示不超时
+	PingInterval         Duration          `json:"ping_interval"`          // 向设备发送ping的间隔
+	PongWait             Duration          `json:"pong_wait"`              // 超过这个时间没有收到设备的任何数据（包括pong）就认为设备已下线
+	WriteWait            Duration          `json:"write_wait"`             // 向设备写一条消息的超时
+	UpstreamPingInterval Duration          `json:"upstream_ping_interval"` // 向s10发送ping的间隔
+	UpstreamPongWait     Duration          `json:"upstream_pong_wait"`     // 超过这个时间没有收到s10的任何数据就重连
+	SyncRoutes           bool              `json:"sync_routes"`            // 连上s10后是否向s10请求路由表并与本地对齐
+	ShutdownTimeout      Duration          `json:"shutdown_timeout"`       // 收到退出信号后最多等待多久
+	StateReportInterval  Duration          `json:"state_report_interval"`  // 打印当前状态的间隔
+	ConnReportInterval   Duration          `json:"conn_report_interval"`   // 打印每个连接状态的间隔
+	InCmdBuffer          int               `json:"in_cmd_buffer"`          // s10下发指令管道的缓冲大小
+	OutQueueSize         int               `json:"out_queue_size"`         // 发给s10的指令队列的长度上限
+	OutQueuePolicy       string            `json:"out_queue_policy"`       // 队列满了之后丢弃哪条指令：drop-oldest, drop-newest
+	OutQueueCoalesce     bool              `json:"out_queue_coalesce"`     // 是否把积压的多条report合并成一份当前状态
+	OutQueueFile         string            `json:"out_queue_file"`         // 队列持久化的文件，为空则只保存在内存中
+	ClientReadBuffer     int               `json:"client_read_buffer"`     // 设备读管道的缓冲大小，转发跟不上时先放在这里，满了之后最多等WriteWait
+	ClientWriteBuffer    int               `json:"client_write_buffer"`    // 设备写队列的长度
+	WritePolicy          string            `json:"write_policy"`           // 设备写队列满了之后的处理方式，见 WritePolicy* 常量
+	WritePolicies        map[string]string `json:"write_policies"`         // 按设备类型单独设置的处理方式，键是DeviceType
+	DuplicateKeyPolicy   string            `json:"duplicate_key_policy"`   // 同一个key重复连接时的处理方式，见 DuplicateKey* 常量
+	BroadcastTimeout     Duration          `json:"broadcast_timeout"`      // broadcast指令没有带timeout时广播持续多久，0表示不超时
+	LogLevel             string            `json:"log_level"`              // 日志级别：debug, info, warn, error，运行中可以用loglevel指令修改
+	LogFormat            string            `json:"log_format"`             // 日志格式：console, json
+	LogRedact            bool              `json:"log_redact"`             // 日志中是否隐藏设备key和转发的数据
+}
+
+// 默认配置，与原来写死在代码中的值保持一致
+func Default() *Config {
+	return &Config{
+		S10URL:               "ws://192.168.1.85:9910/?clienttype=s12",
+		ListenAddr:           ":9911",
+		WSPath:               "/ws",
+		MetricsPath:          "/metrics",
+		MetricsRedact:        true,
+		AdminPath:            "/admin/",
+		AdminToken:           "",
+		ReconnectDelay:       Duration{5 * time.Second},
+		ReconnectMaxDelay:    Duration{2 * time.Minute},
+		PendingRouteTimeout:  Duration{5 * time.Minute},
+		PingInterval:         Duration{30 * time.Second},
+		PongWait:             Duration{60 * time.Second},
+		WriteWait:            Duration{10 * time.Second},
+		UpstreamPingInterval: Duration{20 * time.Second},
+		UpstreamPongWait:     Duration{60 * time.Second},
+		SyncRoutes:           false,
+		ShutdownTimeout:      Duration{10 * time.Second},
+		StateReportInterval:  Duration{20 * time.Second},
+		ConnReportInterval:   Duration{10 * time.Second},
+		InCmdBuffer:          100,
+		OutQueueSize:         1000,
+		OutQueuePolicy:       commands.DropOldest,
+		OutQueueCoalesce:     true,
+		OutQueueFile:         "",
+		ClientReadBuffer:     0,
+		ClientWriteBuffer:    64,
+		WritePolicy:          WritePolicyBlock,
+		WritePolicies:        map[string]string{},
+		DuplicateKeyPolicy:   DuplicateKeyKick,
+		BroadcastTimeout:     Duration{10 * time.Minute},
+		LogLevel:             "info",
+		LogFormat:            logger.FormatConsole,
+		LogRedact:            true,
+	}
+}
+
+// 环境变量的前缀
+const envPrefix = "S12_"
+
+// 一个可配置项：命令行参数名、环境变量名以及如何把字符串写入配置
+type option struct {
+	name  string
+	usage string
+	set   setter
+}
+
+// 把字符串写入配置中的一项
+// boolean为true时命令行参数可以不带值，-sync-routes 等同于 -sync-routes=true
+type setter struct {
+	apply   func(c *Config, value string) error
+	boolean bool
+}
+
+func (o option) env() string {
+	return envPrefix + strings.ToUpper(strings.Replace(o.name, "-", "_", -1))
+}
+
+var options = []option{
+	{"s10-url", "upstream s10 websocket url", stringOption(func(c *Config) *string { return &c.S10URL })},
+	{"listen-addr", "address to accept device connections on", stringOption(func(c *Config) *string { return &c.ListenAddr })},
+	{"ws-path", "websocket path for device connections", stringOption(func(c *Config) *string { return &c.WSPath })},
+	{"metrics-path", "path of the Prometheus metrics endpoint, empty to disable", stringOption(func(c *Config) *string { return &c.MetricsPath })},
+	{"metrics-redact", "label routes with a hash of the device keys instead of the keys", boolOption(func(c *Config) *bool { return &c.MetricsRedact })},
+	{"admin-path", "path prefix of the admin API, must end with /", stringOption(func(c *Config) *string { return &c.AdminPath })},
+	{"admin-token", "bearer token of the admin API, empty to disable it", stringOption(func(c *Config) *string { return &c.AdminToken })},
+	{"reconnect-delay", "initial delay before reconnecting to s10", durationOption(func(c *Config) *Duration { return &c.ReconnectDelay })},
+	{"reconnect-max-delay", "upper bound of the reconnect backoff", durationOption(func(c *Config) *Duration { return &c.ReconnectMaxDelay })},
+	{"pending-route-timeout", "how long a route waits for an offline device before it is reported to s10", durationOption(func(c *Config) *Duration { return &c.PendingRouteTimeout })},
+	{"ping-interval", "interval of pings sent to devices", durationOption(func(c *Config) *Duration { return &c.PingInterval })},
+	{"pong-wait", "how long a silent device is kept before it is dropped", durationOption(func(c *Config) *Duration { return &c.PongWait })},
+	{"write-wait", "timeout of a single write to a device", durationOption(func(c *Config) *Duration { return &c.WriteWait })},
+	{"upstream-ping-interval", "interval of pings sent to s10", durationOption(func(c *Config) *Duration { return &c.UpstreamPingInterval })},
+	{"upstream-pong-wait", "how long s10 may stay silent before reconnecting", durationOption(func(c *Config) *Duration { return &c.UpstreamPongWait })},
+	{"sync-routes", "request the route list from s10 after every connect", boolOption(func(c *Config) *bool { return &c.SyncRoutes })},
+	{"shutdown-timeout", "deadline of the graceful shutdown", durationOption(func(c *Config) *Duration { return &c.ShutdownTimeout })},
+	{"state-report-interval", "interval of the state report", durationOption(func(c *Config) *Duration { return &c.StateReportInterval })},
+	{"conn-report-interval", "interval of the per connection report", durationOption(func(c *Config) *Duration { return &c.ConnReportInterval })},
+	{"in-cmd-buffer", "buffer size of commands from s10", intOption(func(c *Config) *int { return &c.InCmdBuffer })},
+	{"out-queue-size", "max number of commands queued for s10", intOption(func(c *Config) *int { return &c.OutQueueSize })},
+	{"out-queue-policy", "which command to drop when the s10 queue is full: drop-oldest or drop-newest", stringOption(func(c *Config) *string { return &c.OutQueuePolicy })},
+	{"out-queue-coalesce", "collapse queued reports into one snapshot", boolOption(func(c *Config) *bool { return &c.OutQueueCoalesce })},
+	{"out-queue-file", "file to persist the s10 queue in", stringOption(func(c *Config) *string { return &c.OutQueueFile })},
+	{"client-read-buffer", "buffer size of the device read channel; when it is full a frame waits at most write-wait for its route", intOption(func(c *Config) *int { return &c.ClientReadBuffer })},
+	{"client-write-buffer", "length of the per device write queue", intOption(func(c *Config) *int { return &c.ClientWriteBuffer })},
+	{"write-policy", "what to do when a device write queue is full: block, drop-oldest, drop-newest or disconnect", stringOption(func(c *Config) *string { return &c.WritePolicy })},
+	{"write-policies", "per device type write policies, e.g. papp=drop-oldest,s2=block", mapOption(func(c *Config) *map[string]string { return &c.WritePolicies })},
+	{"duplicate-key-policy", "what to do when a device connects with a key that is already online: reject, kick or multi", stringOption(func(c *Config) *string { return &c.DuplicateKeyPolicy })},
+	{"broadcast-timeout", "how long a broadcast lasts when the command has no timeout, 0 for no limit", durationOption(func(c *Config) *Duration { return &c.BroadcastTimeout })},
+	{"log-level", "log level: debug, info, warn or error", stringOption(func(c *Config) *string { return &c.LogLevel })},
+	{"log-format", "log format: console or json", stringOption(func(c *Config) *string { return &c.LogFormat })},
+	{"log-redact", "hide device keys and forwarded payloads in the log", boolOption(func(c *Config) *bool { return &c.LogRedact })},
+}
+
+func stringOption(field func(c *Config) *string) setter {
+	return setter{apply: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intOption(field func(c *Config) *int) setter {
+	return setter{apply: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolOption(field func(c *Config) *bool) setter {
+	return setter{apply: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}, boolean: true}
+}
+
+// 解析 "k=v,k=v" 格式的配置
+func mapOption(field func(c *Config) *map[string]string) setter {
+	return setter{apply: func(c *Config, value string) error {
+		m := make(map[string]string)
+		for _, item := range strings.Split(value, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("malformed item %q", item)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		*field(c) = m
+		return nil
+	}}
+}
+
+func durationOption(field func(c *Config) *Duration) setter {
+	return setter{apply: func(c *Config, value string) error {
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		field(c).Duration = d
+		return nil
+	}}
+}
+
+// 命令行参数的值，解析之后再按 option 写入配置
+type flagValue struct {
+	value   string
+	boolean bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *flagValue) Set(value string) error {
+	v.value = value
+	return nil
+}
+
+// flag包据此允许 -name 不带值，这时Set收到"true"
+func (v *flagValue) IsBoolFlag() bool {
+	return v.boolean
+}
+
+// 加载配置
+// args 为命令行参数（不包含程序名）
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("s12", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path of the json config file")
+	for _, opt := range options {
+		fs.Var(&flagValue{boolean: opt.set.boolean}, opt.name, opt.usage+" (env "+opt.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	conf := Default()
+
+	if *configFile != "" {
+		if err := conf.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := os.LookupEnv(opt.env()); ok {
+			if err := opt.set.apply(conf, value); err != nil {
+				return nil, fmt.Errorf("invalid env %s: %v", opt.env(), err)
+			}
+		}
+	}
+
+	// 只有显式传入的参数才覆盖前面的配置
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range options {
+			if opt.name == f.Name && flagErr == nil {
+				if err := opt.set.apply(conf, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("invalid flag -%s: %v", opt.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %v", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("decode config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// 检查配置是否合法
+func (c *Config) Validate() error {
+	if c.S10URL == "" {
+		return errors.New("s10_url is empty")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("listen_addr is empty")
+	}
+	if !strings.HasPrefix(c.WSPath, "/") {
+		return errors.New("ws_path must start with /")
+	}
+	if c.MetricsPath != "" && (!strings.HasPrefix(c.MetricsPath, "/") || c.MetricsPath == c.WSPath) {
+		return errors.New("metrics_path must start with / and differ from ws_path")
+	}
+	if c.AdminToken != "" {
+		if !strings.HasPrefix(c.AdminPath, "/") || !strings.HasSuffix(c.AdminPath, "/") {
+			return errors.New("admin_path must start and end with /")
+		}
+		if strings.HasPrefix(c.WSPath, c.AdminPath) || (c.MetricsPath != "" && strings.HasPrefix(c.MetricsPath, c.AdminPath)) {
+			return errors.New("admin_path must not contain ws_path or metrics_path")
+		}
+	}
+	if c.ReconnectDelay.Duration <= 0 || c.ReconnectMaxDelay.Duration <= 0 || c.StateReportInterval.Duration <= 0 || c.ConnReportInterval.Duration <= 0 ||
+		c.PingInterval.Duration <= 0 || c.PongWait.Duration <= 0 || c.WriteWait.Duration <= 0 ||
+		c.UpstreamPingInterval.Duration <= 0 || c.UpstreamPongWait.Duration <= 0 || c.ShutdownTimeout.Duration <= 0 {
+		return errors.New("durations must be positive")
+	}
+	if c.ReconnectMaxDelay.Duration < c.ReconnectDelay.Duration {
+		return errors.New("reconnect_max_delay must not be shorter than reconnect_delay")
+	}
+	if c.PongWait.Duration <= c.PingInterval.Duration {
+		return errors.New("pong_wait must be longer than ping_interval")
+	}
+	if c.UpstreamPongWait.Duration <= c.UpstreamPingInterval.Duration {
+		return errors.New("upstream_pong_wait must be longer than upstream_ping_interval")
+	}
+	if c.PendingRouteTimeout.Duration < 0 {
+		return errors.New("pending_route_timeout must not be negative")
+	}
+	if c.BroadcastTimeout.Duration < 0 {
+		return errors.New("broadcast_timeout must not be negative")
+	}
+	if c.InCmdBuffer < 0 || c.ClientReadBuffer < 0 || c.ClientWriteBuffer < 0 {
+		return errors.New("buffer sizes must not be negative")
+	}
+	for _, policy := range c.WritePolicies {
+		if !validWritePolicy(policy) {
+			return fmt.Errorf("unknown write policy %q", policy)
+		}
+	}
+	if !validWritePolicy(c.WritePolicy) {
+		return fmt.Errorf("unknown write_policy %q", c.WritePolicy)
+	}
+	// 除了block，其它处理方式都靠写队列判断设备是否跟得上，没有队列时只要设备在写就会丢数据或被断开
+	if c.ClientWriteBuffer < 1 {
+		if c.WritePolicy != WritePolicyBlock {
+			return fmt.Errorf("write_policy %q needs client_write_buffer of at least 1", c.WritePolicy)
+		}
+		for deviceType, policy := range c.WritePolicies {
+			if policy != WritePolicyBlock {
+				return fmt.Errorf("write policy %q of %s needs client_write_buffer of at least 1", policy, deviceType)
+			}
+		}
+	}
+	if c.OutQueueSize < 1 {
+		return errors.New("out_queue_size must be positive")
+	}
+	if c.OutQueuePolicy != commands.DropOldest && c.OutQueuePolicy != commands.DropNewest {
+		return fmt.Errorf("unknown out_queue_policy %q", c.OutQueuePolicy)
+	}
+	switch c.DuplicateKeyPolicy {
+	case DuplicateKeyReject, DuplicateKeyKick, DuplicateKeyMulti:
+	default:
+		return fmt.Errorf("unknown duplicate_key_policy %q", c.DuplicateKeyPolicy)
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("unknown log_level %q", c.LogLevel)
+	}
+	if c.LogFormat != logger.FormatConsole && c.LogFormat != logger.FormatJSON {
+		return fmt.Errorf("unknown log_format %q", c.LogFormat)
+	}
+	return nil
+}
+
+// 设备写队列满了之后的处理方式
+const (
+	WritePolicyBlock      = "block"       // 等待设备把数据取走，会拖慢同一路由上的其它设备；发送方的数据最多等WriteWait，之后丢掉
+	WritePolicyDropOldest = "drop-oldest" // 丢掉队列中最早的数据
+	WritePolicyDropNewest = "drop-newest" // 丢掉新来的数据
+	WritePolicyDisconnect = "disconnect"  // 断开跟不上的设备
+)
+
+// 同一个key已经在线时，又有设备用这个key连接上来的处理方式
+const (
+	DuplicateKeyReject = "reject" // 拒绝新的连接
+	DuplicateKeyKick   = "kick"   // 断开原来的连接，保留新的
+	DuplicateKeyMulti  = "multi"  // 两个连接同时在线，按key查找时取最新的一个
+)
+
+func validWritePolicy(policy string) bool {
+	switch policy {
+	case WritePolicyBlock, WritePolicyDropOldest, WritePolicyDropNewest, WritePolicyDisconnect:
+		return true
+	}
+	return false
+}
+
+// 某种设备的写队列处理方式
+func (c *Config) WritePolicyFor(deviceType string) string {
+	if policy, ok := c.WritePolicies[deviceType]; ok {
+		return policy
+	}
+	return c.WritePolicy
+}
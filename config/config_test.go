@@ -0,0 +1,66 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 默认值 < 配置文件 < 环境变量 < 命令行参数
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s12-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "s12.json")
+	if err := ioutil.WriteFile(file, []byte(`{"listen_addr": ":7001", "ws_path": "/file", "log_level": "warn"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		args       []string
+		listenAddr string
+		wsPath     string
+		logLevel   string
+		syncRoutes bool
+	}{
+		{"default", nil, nil, ":9911", "/ws", "info", false},
+		{"file", nil, []string{"-config", file}, ":7001", "/file", "warn", false},
+		{"env over file", map[string]string{"S12_WS_PATH": "/env", "S12_SYNC_ROUTES": "true"}, []string{"-config", file}, ":7001", "/env", "warn", true},
+		{"flag over env", map[string]string{"S12_WS_PATH": "/env", "S12_SYNC_ROUTES": "true"}, []string{"-config", file, "-ws-path", "/flag", "-sync-routes=false"}, ":7001", "/flag", "warn", false},
+		{"config file from env", map[string]string{"S12_CONFIG": file, "S12_LOG_LEVEL": "error"}, nil, ":7001", "/file", "error", false},
+		{"bare bool flag", nil, []string{"-sync-routes", "-log-level", "debug"}, ":9911", "/ws", "debug", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+			}
+			defer func() {
+				for k := range tt.env {
+					os.Unsetenv(k)
+				}
+			}()
+
+			conf, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load(%q): %v", tt.args, err)
+			}
+			if conf.ListenAddr != tt.listenAddr || conf.WSPath != tt.wsPath || conf.LogLevel != tt.logLevel || conf.SyncRoutes != tt.syncRoutes {
+				t.Fatalf("listen_addr %q, ws_path %q, log_level %q, sync_routes %v; want %q, %q, %q, %v",
+					conf.ListenAddr, conf.WSPath, conf.LogLevel, conf.SyncRoutes,
+					tt.listenAddr, tt.wsPath, tt.logLevel, tt.syncRoutes)
+			}
+		})
+	}
+}
+
+func TestLoadInvalidBoolFlag(t *testing.T) {
+	if _, err := Load([]string{"-sync-routes=maybe"}); err == nil {
+		t.Fatal("-sync-routes=maybe was accepted")
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// 配置文件中的时间间隔
+// 既可以写成 "5s"、"1m30s" 这样的字符串，也可以直接写秒数
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+// 没有单位的数字按秒处理
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
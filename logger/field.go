@@ -0,0 +1,156 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 日志中的一个字段
+type Field struct {
+	Key string
+
+	raw       interface{}
+	sensitive int // 见下面的常量，输出时按是否脱敏决定怎么显示raw
+}
+
+const (
+	plain   = iota // 原样输出
+	secret         // 设备key之类的标识，脱敏时只保留开头两个字符
+	payload        // 转发的数据，脱敏时只输出长度
+	route          // from->to，两端都是设备key
+	errKeys        // 错误信息中可能带着设备key，脱敏时把这些key替换掉
+)
+
+func (f Field) value(redact bool) interface{} {
+	switch f.sensitive {
+	case secret:
+		if redact {
+			return maskKey(f.raw.(string))
+		}
+	case route:
+		pair := f.raw.([2]string)
+		if redact {
+			return maskKey(pair[0]) + "->" + maskKey(pair[1])
+		}
+		return pair[0] + "->" + pair[1]
+	case errKeys:
+		e := f.raw.(keyedError)
+		if redact {
+			return maskIn(e.msg, e.keys)
+		}
+		return e.msg
+	case payload:
+		data := f.raw.([]byte)
+		if redact {
+			return strconv.Itoa(len(data)) + " bytes"
+		}
+		return string(data)
+	}
+	return f.raw
+}
+
+// 只保留开头两个字符和长度，足够在日志中区分不同的设备
+func maskKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	runes := []rune(key)
+	if len(runes) <= 2 {
+		return fmt.Sprintf("***(%d)", len(runes))
+	}
+	return fmt.Sprintf("%s***(%d)", string(runes[:2]), len(runes))
+}
+
+// 普通字段，原样输出
+func F(key string, value interface{}) Field {
+	return Field{Key: key, raw: value}
+}
+
+// 设备key
+func Key(key string) Field {
+	return Field{Key: "key", raw: key, sensitive: secret}
+}
+
+// 其它需要脱敏的标识，比如s12的key
+func Secret(name, value string) Field {
+	return Field{Key: name, raw: value, sensitive: secret}
+}
+
+// 一条路由，两端都是设备key，脱敏时分别处理
+func Route(from, to string) Field {
+	return Field{Key: "route", raw: [2]string{from, to}, sensitive: route}
+}
+
+// 指令的id
+func CmdId(id int64) Field {
+	return Field{Key: "cmdid", raw: id}
+}
+
+// 指令名
+func Cmd(cmd string) Field {
+	return Field{Key: "cmd", raw: cmd}
+}
+
+// 转发或收到的数据，脱敏时只输出长度
+func Payload(data []byte) Field {
+	return Field{Key: "payload", raw: data, sensitive: payload}
+}
+
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", raw: nil}
+	}
+	return Field{Key: "error", raw: err.Error()}
+}
+
+// 错误信息中带着的设备key，比如指令执行失败的原因
+type keyedError struct {
+	msg  string
+	keys []string
+}
+
+// 错误信息中的这些key和 Key 一样脱敏
+func ErrKeys(err error, keys ...string) Field {
+	if err == nil {
+		return Err(nil)
+	}
+	return Field{Key: "error", raw: keyedError{err.Error(), keys}, sensitive: errKeys}
+}
+
+// key前后的字符，用来判断找到的是一个完整的key，而不是别的单词的一部分
+const keyBoundary = " \t\n\"'`,=()<>:;[]{}"
+
+// 把text中完整出现的每个key替换成 maskKey 的结果
+// 同一位置先试长的key，避免短的key把长的key替换掉一部分；只扫描一遍，不会替换已经脱敏的内容
+func maskIn(text string, keys []string) string {
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != "" {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		matched := false
+		if i == 0 || strings.IndexByte(keyBoundary, text[i-1]) >= 0 {
+			for _, key := range sorted {
+				end := i + len(key)
+				if strings.HasPrefix(text[i:], key) && (end == len(text) || strings.IndexByte(keyBoundary, text[end]) >= 0) {
+					b.WriteString(maskKey(key))
+					i = end
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			b.WriteByte(text[i])
+			i++
+		}
+	}
+	return b.String()
+}
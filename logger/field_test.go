@@ -0,0 +1,22 @@
+package logger
+
+import "testing"
+
+func TestMaskIn(t *testing.T) {
+	tests := []struct {
+		text string
+		keys []string
+		want string
+	}{
+		{"route a -> b already exists", []string{"a", "b"}, "route ***(1) -> ***(1) already exists"},
+		{"device faghjag is not online", []string{"faghjag"}, "device fa***(7) is not online"},
+		{`unknown key "ab,abc"`, []string{"ab", "abc"}, `unknown key "***(2),ab***(3)"`},
+		{"route 5 -> x5", []string{"5"}, "route ***(1) -> x5"},
+		{"nothing to hide", []string{"", "zz"}, "nothing to hide"},
+	}
+	for _, tt := range tests {
+		if got := maskIn(tt.text, tt.keys); got != tt.want {
+			t.Errorf("maskIn(%q, %q) = %q, want %q", tt.text, tt.keys, got, tt.want)
+		}
+	}
+}
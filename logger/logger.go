@@ -0,0 +1,191 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 日志级别，低于当前级别的日志不输出
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// 解析配置或s10指令中的日志级别
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", value)
+}
+
+// 日志的输出格式
+const (
+	FormatConsole = "console" // 一行文本：时间 级别 消息 key=value ...
+	FormatJSON    = "json"    // 一行一个json对象
+)
+
+// 带级别和字段的日志，可以并发使用
+// 级别和是否脱敏可以在运行时修改
+type Logger struct {
+	level  int32
+	redact int32
+	format string
+
+	lock sync.Mutex // 保证每条日志完整地写出去
+	out  io.Writer
+}
+
+func New(out io.Writer, format string, level Level, redact bool) *Logger {
+	l := &Logger{out: out, format: format}
+	l.SetLevel(level)
+	l.SetRedact(redact)
+	return l
+}
+
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// 是否对设备key和数据内容脱敏，见 Key 和 Payload
+func (l *Logger) SetRedact(redact bool) {
+	var value int32
+	if redact {
+		value = 1
+	}
+	atomic.StoreInt32(&l.redact, value)
+}
+
+func (l *Logger) Redacting() bool {
+	return atomic.LoadInt32(&l.redact) == 1
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(DebugLevel, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(InfoLevel, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(WarnLevel, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(ErrorLevel, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	redact := l.Redacting()
+
+	var line []byte
+	if l.format == FormatJSON {
+		line = l.jsonLine(now, level, msg, fields, redact)
+	} else {
+		line = l.consoleLine(now, level, msg, fields, redact)
+	}
+
+	l.lock.Lock()
+	l.out.Write(line)
+	l.lock.Unlock()
+}
+
+func (l *Logger) consoleLine(now time.Time, level Level, msg string, fields []Field, redact bool) []byte {
+	var b strings.Builder
+	b.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" ")
+	b.WriteString(fmt.Sprintf("%-5s", strings.ToUpper(level.String())))
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for _, field := range fields {
+		b.WriteString(" ")
+		b.WriteString(field.Key)
+		b.WriteString("=")
+		value := fmt.Sprint(field.value(redact))
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		b.WriteString(value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func (l *Logger) jsonLine(now time.Time, level Level, msg string, fields []Field, redact bool) []byte {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for _, field := range fields {
+		value := field.value(redact)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[field.Key] = value
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": level.String(),
+			"msg":   msg,
+			"error": "can't encode log fields: " + err.Error(),
+		})
+	}
+	return append(line, '\n')
+}
+
+// 默认的日志，启动时按配置调用 Init 重新设置
+var std = New(os.Stdout, FormatConsole, InfoLevel, true)
+
+// 按配置设置默认的日志
+// 必须在其它协程开始写日志之前调用
+func Init(out io.Writer, format string, level Level, redact bool) {
+	std = New(out, format, level, redact)
+}
+
+func Default() *Logger { return std }
+
+func SetLevel(level Level) { std.SetLevel(level) }
+func GetLevel() Level      { return std.Level() }
+
+func Enabled(level Level) bool { return std.Enabled(level) }
+
+func Debug(msg string, fields ...Field) { std.log(DebugLevel, msg, fields) }
+func Info(msg string, fields ...Field)  { std.log(InfoLevel, msg, fields) }
+func Warn(msg string, fields ...Field)  { std.log(WarnLevel, msg, fields) }
+func Error(msg string, fields ...Field) { std.log(ErrorLevel, msg, fields) }
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
 	"sanji_s12/client"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"sanji_s12/logger"
 	"sanji_s12/server"
 	"syscall"
 )
@@ -24,29 +27,75 @@ import (
 
 func main() {
 
+	// 读取配置：配置文件 < 环境变量 < 命令行参数
+	conf, err := config.Load(os.Args[1:])
+	if err != nil {
+		logger.Error("load config error", logger.Err(err))
+		os.Exit(1)
+	}
+	// Validate已经检查过级别
+	level, _ := logger.ParseLevel(conf.LogLevel)
+	logger.Init(os.Stdout, conf.LogFormat, level, conf.LogRedact)
+
+	manager := server.NewClientManager(conf)
+
+	// 发给s10的指令先进队列，s10断线时积压的report合并成一份当前状态
+	outQueue := commands.NewOutQueue(conf.OutQueueSize, conf.OutQueuePolicy, conf.OutQueueCoalesce, conf.OutQueueFile)
+	outQueue.Snapshot = manager.SnapshotReport
+	commands.InitChans(conf.InCmdBuffer, outQueue)
 
 	// 开启s12客户端，连接s10
-	go client.WSClient()
+	// 每次连上s10都先上报当前的连接信息
+	upstream := client.WSClient(conf, manager.HandshakeCommands)
 
 	// 开启s12服务端，监听设备的连接,处理指令
-	go server.Manager.Start()
-	go server.Manager.HandleCommand()
-	go server.Manager.ReportCurrentState()
+	go manager.Start()
+	go manager.HandleCommand()
+	go manager.ReportCurrentState()
 
-	http.HandleFunc("/ws", server.WSServer)
-	if err := http.ListenAndServe(":9911", nil); err != nil {
-		fmt.Println("http server error: ", err.Error())
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.WSPath, manager.WSServer)
+	if conf.MetricsPath != "" {
+		manager.Metrics.Register(upstream)
+		mux.Handle(conf.MetricsPath, manager.Metrics)
 	}
-
-
+	if conf.AdminToken != "" {
+		mux.Handle(conf.AdminPath, server.NewAdminServer(manager, conf.AdminPath, conf.AdminToken))
+	}
+	srv := &http.Server{Addr: conf.ListenAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("http server error", logger.Err(err))
+			os.Exit(1)
+		}
+	}()
 
 	// 在主线程中阻塞，防止程序退出
-	c := make(chan os.Signal)
-	//监听指定信号 ctrl+c kill
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGKILL)
-	//阻塞直到有信号传入
-	fmt.Println("启动")
+	c := make(chan os.Signal, 1)
+	//监听指定信号 ctrl+c kill（SIGKILL无法捕获）
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	logger.Info("启动", logger.F("listen", conf.ListenAddr), logger.F("loglevel", level.String()))
 	//阻塞直至有信号传入
 	s := <-c
-	fmt.Println("退出信号", s)
+	logger.Info("退出信号", logger.F("signal", s.String()))
+
+	// 优雅退出，最多等待ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout.Duration)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		// 先停止接受新的设备连接，再断开已有的设备，最后把积压的指令发给s10
+		srv.Shutdown(ctx)
+		manager.Shutdown(ctx, "s12 shutdown")
+		upstream.Shutdown(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("退出完成")
+	case <-ctx.Done():
+		logger.Warn("退出超时")
+	}
 }
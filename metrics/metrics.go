@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus文本格式的指标，不依赖官方的客户端库
+// 格式见 https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// 抓取时输出一组或多组指标
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// 用函数实现Collector，抓取时才去读当前的状态
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) { f(w) }
+
+// 所有指标，实现了http.Handler，挂到/metrics上
+type Registry struct {
+	lock       sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// 按注册的顺序输出
+func (r *Registry) Register(collector Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.collectors = append(r.collectors, collector)
+}
+
+func (r *Registry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := &Writer{out: bufio.NewWriter(res)}
+	for _, collector := range collectors {
+		collector.Collect(w)
+	}
+	w.out.Flush()
+}
+
+// 按文本格式写指标
+type Writer struct {
+	out *bufio.Writer
+}
+
+// 一组指标的说明和类型，必须在这组指标的数据之前写
+func (w *Writer) Family(name, help, typ string) {
+	w.out.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.out.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// 一个数据，labels按 名字, 值, 名字, 值... 的顺序给出
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.out.WriteString(name)
+	if len(labels) > 0 {
+		w.out.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.out.WriteString(",")
+			}
+			w.out.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		w.out.WriteString("}")
+	}
+	w.out.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// 只有一个数据、没有label的一组指标
+func (w *Writer) Single(name, help, typ string, value float64) {
+	w.Family(name, help, typ)
+	w.Sample(name, value)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// 带label的计数，比如按指令名统计的指令数
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	lock   sync.RWMutex
+	values map[string]*counterValue // 键是label的值用\xff连起来
+}
+
+type counterValue struct {
+	labels []string
+	n      int64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: make(map[string]*counterValue),
+	}
+}
+
+// label的值按 Labels 的顺序给出
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(delta int64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.lock.RLock()
+	value, ok := c.values[key]
+	c.lock.RUnlock()
+
+	if !ok {
+		c.lock.Lock()
+		if value, ok = c.values[key]; !ok {
+			value = &counterValue{labels: append([]string(nil), values...)}
+			c.values[key] = value
+		}
+		c.lock.Unlock()
+	}
+	atomic.AddInt64(&value.n, delta)
+}
+
+// 当前的值，没有计过数时为0
+func (c *CounterVec) Value(values ...string) int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if value, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return atomic.LoadInt64(&value.n)
+	}
+	return 0
+}
+
+// 按label的值排序输出，每次抓取的顺序相同
+func (c *CounterVec) Collect(w *Writer) {
+	c.lock.RLock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*counterValue, len(keys))
+	for index, key := range keys {
+		values[index] = c.values[key]
+	}
+	c.lock.RUnlock()
+
+	w.Family(c.Name, c.Help, TypeCounter)
+	labels := make([]string, 2*len(c.Labels))
+	for _, value := range values {
+		for index, name := range c.Labels {
+			labels[2*index] = name
+			labels[2*index+1] = value.labels[index]
+		}
+		w.Sample(c.Name, float64(atomic.LoadInt64(&value.n)), labels...)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sanji_s12/commands"
+	"sanji_s12/logger"
+	"strings"
+	"time"
+)
+
+// 管理接口等待指令执行的最长时间，HandleCommand的协程可能正在执行别的指令
+const adminExecTimeout = 10 * time.Second
+
+// 管理接口，与s10断开时也可以在本地查看和修改s12的状态
+// 请求必须带上 Authorization: Bearer <AdminToken>
+// 修改状态的请求转成对应的指令，和s10的指令走同一条路径执行
+//
+//	GET    clients?devicetype=&mac=  在线的设备
+//	GET    clients/<key>             一个设备
+//	DELETE clients/<key>             断开这个设备，同close指令
+//	GET    routes                    路由表
+//	POST   routes                    建立路由，body与conn指令相同：{"from","to","msgtype","persist","envelope","duplex"}
+//	DELETE routes?from=&to=          断开路由，同disconn指令
+//	GET    broadcasts                正在进行的广播
+//	GET    keys                      允许连接的key
+//	POST   keys                      允许一个key连接，body为{"key":"..."}，同accept指令
+//	DELETE keys/<key>                不再允许这个key连接，同revoke指令
+type AdminServer struct {
+	manager *ClientManager
+	prefix  string
+	token   string
+}
+
+func NewAdminServer(manager *ClientManager, prefix, token string) *AdminServer {
+	return &AdminServer{manager: manager, prefix: prefix, token: token}
+}
+
+// 管理接口的回复，code和msg与ack指令相同
+type adminReply struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// 管理接口中的路由表，格式与report中的相同
+type adminRoutes struct {
+	Routes map[string][]string `json:"routes"`
+	Duplex map[string][]string `json:"duplex,omitempty"`
+}
+
+func (a *AdminServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		a.manager.metrics.admin.Inc()
+		logger.Warn("admin request unauthorized", logger.F("method", req.Method), logger.F("addr", req.RemoteAddr))
+		res.Header().Set("WWW-Authenticate", `Bearer realm="s12"`)
+		writeAdmin(res, http.StatusUnauthorized, adminReply{Code: commands.CodeBadData, Msg: "unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, a.prefix)
+	resource, key := path, ""
+	if index := strings.Index(path, "/"); index >= 0 {
+		resource, key = path[:index], path[index+1:]
+	}
+	logger.Info("admin request", logger.F("method", req.Method), logger.F("resource", resource), logger.F("addr", req.RemoteAddr))
+
+	switch {
+	case resource == "clients" && key == "" && req.Method == http.MethodGet:
+		query := req.URL.Query()
+		a.reply(res, a.manager.List(ClientFilter{DeviceType: query.Get("devicetype"), Mac: query.Get("mac")}), nil)
+	case resource == "clients" && key != "" && req.Method == http.MethodGet:
+		status, ok := a.manager.Get(key)
+		if !ok {
+			a.reply(res, nil, commands.Errorf(commands.CodeDeviceUnknown, "device %s is not online", key))
+			return
+		}
+		a.reply(res, status, nil)
+	case resource == "clients" && key != "" && req.Method == http.MethodDelete:
+		a.exec(res, req, commands.Cmd{Cmd: "close", Data: key})
+	case resource == "routes" && key == "" && req.Method == http.MethodGet:
+		var routes adminRoutes
+		routes.Routes, routes.Duplex = a.manager.Router.Tables()
+		a.reply(res, routes, nil)
+	case resource == "routes" && key == "" && req.Method == http.MethodPost:
+		var cmd commands.Cmd
+		if err := json.NewDecoder(req.Body).Decode(&cmd); err != nil {
+			a.reply(res, nil, commands.Errorf(commands.CodeBadData, "can't decode route: %v", err))
+			return
+		}
+		// 只取conn指令用到的字段
+		a.exec(res, req, commands.Cmd{
+			Cmd:      "conn",
+			From:     cmd.From,
+			To:       cmd.To,
+			MsgType:  cmd.MsgType,
+			Persist:  cmd.Persist,
+			Envelope: cmd.Envelope,
+			Duplex:   cmd.Duplex,
+		})
+	case resource == "routes" && key == "" && req.Method == http.MethodDelete:
+		query := req.URL.Query()
+		a.exec(res, req, commands.Cmd{Cmd: "disconn", From: query.Get("from"), To: query.Get("to")})
+	case resource == "broadcasts" && key == "" && req.Method == http.MethodGet:
+		a.reply(res, a.manager.BroadcastList(), nil)
+	case resource == "keys" && key == "" && req.Method == http.MethodGet:
+		a.reply(res, commands.AllowedKeys(), nil)
+	case resource == "keys" && key == "" && req.Method == http.MethodPost:
+		var body struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			a.reply(res, nil, commands.Errorf(commands.CodeBadData, "can't decode key: %v", err))
+			return
+		}
+		a.exec(res, req, commands.Cmd{Cmd: "accept", Data: body.Key})
+	case resource == "keys" && key != "" && req.Method == http.MethodDelete:
+		a.exec(res, req, commands.Cmd{Cmd: "revoke", Data: key})
+	default:
+		writeAdmin(res, http.StatusNotFound, adminReply{Code: commands.CodeUnknownCmd, Msg: req.Method + " " + req.URL.Path + " is not supported"})
+	}
+}
+
+// 令牌为空时不开启管理接口，main中不会挂上这个handler
+func (a *AdminServer) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || a.token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) == 1
+}
+
+// 交给处理指令的协程执行，指令返回的data原样带回
+func (a *AdminServer) exec(res http.ResponseWriter, req *http.Request, cmd commands.Cmd) {
+	ctx, cancel := context.WithTimeout(req.Context(), adminExecTimeout)
+	defer cancel()
+
+	data, err := a.manager.Exec(ctx, cmd)
+	if err != nil {
+		logger.Warn("admin command failed", logger.Cmd(cmd.Cmd), logger.ErrKeys(err, cmdKeys(cmd)...))
+		a.reply(res, nil, err)
+		return
+	}
+	if data != "" {
+		a.reply(res, json.RawMessage(data), nil)
+		return
+	}
+	a.reply(res, nil, nil)
+}
+
+func (a *AdminServer) reply(res http.ResponseWriter, data interface{}, err error) {
+	code, msg := commands.ErrorCode(err)
+	writeAdmin(res, adminStatus(code, err), adminReply{Code: code, Msg: msg, Data: data})
+}
+
+// 指令的状态码对应的http状态码
+func adminStatus(code int, err error) int {
+	switch code {
+	case commands.CodeOK:
+		return http.StatusOK
+	case commands.CodeBadData:
+		return http.StatusBadRequest
+	case commands.CodeDeviceUnknown, commands.CodeRouteUnknown, commands.CodeBroadcastUnknown, commands.CodeKeyUnknown:
+		return http.StatusNotFound
+	case commands.CodeRouteExists, commands.CodeBroadcastExists:
+		return http.StatusConflict
+	}
+	if err == context.DeadlineExceeded {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeAdmin(res http.ResponseWriter, status int, reply adminReply) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(reply)
+}
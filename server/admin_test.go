@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "secret"
+
+// 管理接口修改状态的请求交给HandleCommand的协程执行，测试里也要把它跑起来
+func newAdminManager() (*ClientManager, *AdminServer) {
+	manager := NewClientManager(config.Default())
+	for _, key := range []string{"a", "b"} {
+		manager.Clients.Add(newBenchClient(key))
+	}
+	go manager.HandleCommand()
+	return manager, NewAdminServer(manager, "/admin/", testAdminToken)
+}
+
+func adminRequest(admin *AdminServer, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	res := httptest.NewRecorder()
+	admin.ServeHTTP(res, req)
+	return res
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	manager, admin := newAdminManager()
+
+	for _, auth := range []string{"", "secret", "Bearer", "Bearer wrong", "Basic secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res := httptest.NewRecorder()
+		admin.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q: status %d, want %d", auth, res.Code, http.StatusUnauthorized)
+		}
+		if res.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("Authorization %q: no WWW-Authenticate header", auth)
+		}
+	}
+	if n := manager.metrics.admin.Value(); n != 5 {
+		t.Fatalf("admin rejections counted %d, want 5", n)
+	}
+
+	// 令牌为空时任何请求都不放行
+	empty := NewAdminServer(manager, "/admin/", "")
+	req := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	res := httptest.NewRecorder()
+	empty.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("empty token: status %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	manager, admin := newAdminManager()
+
+	steps := []struct {
+		method, target, body string
+		status               int
+	}{
+		{http.MethodPost, "/admin/routes", `{"from":"a","to":"b","msgtype":"text"}`, http.StatusOK},
+		{http.MethodPost, "/admin/routes", `{"from":"a","to":"b"}`, http.StatusConflict},
+		{http.MethodPost, "/admin/routes", `{"from":"a"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/routes", `{"from":"a","to":"b","msgtype":"video"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/routes", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "/admin/routes", "", http.StatusOK},
+	}
+	for _, step := range steps {
+		if res := adminRequest(admin, step.method, step.target, step.body); res.Code != step.status {
+			t.Fatalf("%s %s %s: status %d, want %d: %s", step.method, step.target, step.body, res.Code, step.status, res.Body)
+		}
+	}
+	if routes := manager.Router.Snapshot(); !reflect.DeepEqual(routes, map[string][]string{"a": {"b"}}) {
+		t.Fatalf("routes after POST = %v, want a -> b", routes)
+	}
+
+	if res := adminRequest(admin, http.MethodDelete, "/admin/routes?from=a&to=b", ""); res.Code != http.StatusOK {
+		t.Fatalf("DELETE routes: status %d: %s", res.Code, res.Body)
+	}
+	if routes := manager.Router.Snapshot(); len(routes) != 0 {
+		t.Fatalf("routes after DELETE = %v, want none", routes)
+	}
+	if res := adminRequest(admin, http.MethodDelete, "/admin/routes?from=a&to=b", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("DELETE a missing route: status %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminCloseClient(t *testing.T) {
+	manager, admin := newAdminManager()
+	b := manager.Clients.Sessions("b")[0]
+
+	// close指令把设备交给Unregister，这里代替Start接收
+	gone := make(chan *Client, 1)
+	go func() { gone <- <-manager.Unregister }()
+
+	if res := adminRequest(admin, http.MethodDelete, "/admin/clients/b", ""); res.Code != http.StatusOK {
+		t.Fatalf("DELETE clients/b: status %d: %s", res.Code, res.Body)
+	}
+	if client := <-gone; client != b {
+		t.Fatalf("DELETE clients/b unregistered %s", client.Key)
+	}
+	if res := adminRequest(admin, http.MethodDelete, "/admin/clients/x", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("DELETE clients/x: status %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminKeys(t *testing.T) {
+	old := commands.PermissionKey
+	commands.PermissionKey = nil
+	defer func() { commands.PermissionKey = old }()
+	_, admin := newAdminManager()
+
+	steps := []struct {
+		method, target, body string
+		status               int
+		keys                 []string
+	}{
+		{http.MethodPost, "/admin/keys", `{"key":"k1"}`, http.StatusOK, []string{"k1"}},
+		{http.MethodPost, "/admin/keys", `{"key":"k1"}`, http.StatusOK, []string{"k1"}},
+		{http.MethodPost, "/admin/keys", `{"key":""}`, http.StatusBadRequest, []string{"k1"}},
+		{http.MethodPost, "/admin/keys", `{`, http.StatusBadRequest, []string{"k1"}},
+		{http.MethodDelete, "/admin/keys/k1", "", http.StatusOK, []string{}},
+		{http.MethodDelete, "/admin/keys/k1", "", http.StatusNotFound, []string{}},
+		{http.MethodPut, "/admin/keys", "", http.StatusNotFound, []string{}},
+	}
+	for _, step := range steps {
+		if res := adminRequest(admin, step.method, step.target, step.body); res.Code != step.status {
+			t.Fatalf("%s %s %s: status %d, want %d: %s", step.method, step.target, step.body, res.Code, step.status, res.Body)
+		}
+		if keys := commands.AllowedKeys(); !reflect.DeepEqual(keys, step.keys) {
+			t.Fatalf("after %s %s keys = %v, want %v", step.method, step.target, keys, step.keys)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"sanji_s12/commands"
+	"sanji_s12/logger"
+	"sanji_s12/util"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 一次广播
+// 广播期间from的数据只发给接收广播的设备，from原来的点对点路由暂停；
+// 接收广播的设备也不再接收其它路由的数据
+// 广播结束（stopbroadcast指令或者超时）后，这些路由自动恢复
+type BroadcastSession struct {
+	Id       string   `json:"id"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Deadline int64    `json:"deadline"` // 超时的时间 毫秒，0表示不超时
+
+	conn  *Connection // from的连接实例
+	timer *time.Timer
+}
+
+// 正在进行的广播，键是广播的id
+type BroadcastSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*BroadcastSession
+}
+
+func NewBroadcastSessions() *BroadcastSessions {
+	return &BroadcastSessions{
+		sessions: make(map[string]*BroadcastSession),
+	}
+}
+
+// 开始一次广播，返回广播的id
+// id为空时由s12生成；timeout为0表示不超时
+// 一个设备同时只能有一次广播，还没上线的设备上线后自动加入
+func (manager *ClientManager) StartBroadcast(id, fromKey string, toKeys []string, timeout time.Duration) (string, error) {
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	b := manager.Broadcasts
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if id == "" {
+		id = strconv.FormatInt(util.GetCmdId(), 10)
+	}
+	if _, ok := b.sessions[id]; ok {
+		return "", commands.Errorf(commands.CodeBroadcastExists, "broadcast %s already exists", id)
+	}
+	for _, session := range b.sessions {
+		if session.From == fromKey {
+			return "", commands.Errorf(commands.CodeBroadcastExists, "%s is already broadcasting in %s", fromKey, session.Id)
+		}
+	}
+
+	session := &BroadcastSession{Id: id, From: fromKey}
+	seen := make(map[string]bool, len(toKeys))
+	for _, key := range toKeys {
+		if !seen[key] {
+			seen[key] = true
+			session.To = append(session.To, key)
+		}
+	}
+
+	// from还没有连接实例时，为这次广播建一个，广播结束时如果没有别的路由就删掉
+	conn, ok := manager.Router.Connection(fromKey)
+	if !ok {
+		conn = &Connection{
+			WriteClients:   []*Client{},
+			DisconnectChan: make(chan struct{}, 1),
+		}
+		manager.Router.SetConnection(fromKey, conn)
+		go conn.ReportConnectStatus(manager.Config.ConnReportInterval.Duration)
+		manager.WaitForFromKey(conn, fromKey)
+	}
+	session.conn = conn
+
+	var clients []*Client
+	for _, key := range session.To {
+		if client, ok := manager.CheckClientExist(key); ok {
+			client.joinBroadcast()
+			clients = append(clients, client)
+		}
+	}
+	conn.StartBroadcasting(clients)
+
+	manager.armBroadcast(session, timeout)
+	b.sessions[id] = session
+	logger.Info("broadcast started", logger.F("broadcastid", id), logger.Key(fromKey), logger.F("receivers", len(session.To)))
+	return id, nil
+}
+
+// 结束一次广播
+func (manager *ClientManager) StopBroadcast(id string) error {
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	b := manager.Broadcasts
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	session, ok := b.sessions[id]
+	if !ok {
+		return commands.Errorf(commands.CodeBroadcastUnknown, "broadcast %s does not exist", id)
+	}
+	manager.endBroadcast(session)
+	return nil
+}
+
+// 延长一次广播，从现在开始再持续timeout
+func (manager *ClientManager) ExtendBroadcast(id string, timeout time.Duration) error {
+	b := manager.Broadcasts
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	session, ok := b.sessions[id]
+	if !ok {
+		return commands.Errorf(commands.CodeBroadcastUnknown, "broadcast %s does not exist", id)
+	}
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+	manager.armBroadcast(session, timeout)
+	return nil
+}
+
+// 设置广播的超时，超时后结束广播并告知s10
+// 超时在定时器的协程中处理，和指令一样要先拿到 routes，同时可能有conn指令在用这个连接实例
+// 调用时必须持有 Broadcasts.lock
+func (manager *ClientManager) armBroadcast(session *BroadcastSession, timeout time.Duration) {
+	session.Deadline = 0
+	session.timer = nil
+	if timeout <= 0 {
+		return
+	}
+	session.Deadline = time.Now().Add(timeout).UnixNano() / int64(time.Millisecond)
+	session.timer = time.AfterFunc(timeout, func() {
+		manager.routes.Lock()
+		defer manager.routes.Unlock()
+
+		b := manager.Broadcasts
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		// 这期间广播可能已经结束或者延长了
+		if b.sessions[session.Id] != session || time.Now().UnixNano()/int64(time.Millisecond) < session.Deadline {
+			return
+		}
+		logger.Info("broadcast timed out", logger.F("broadcastid", session.Id))
+		manager.endBroadcast(session)
+		commands.OutCmdQueue.Push(commands.Cmd{
+			CmdId: util.GetCmdId(),
+			Cmd:   "broadcastend",
+			Role:  "client",
+			From:  session.From,
+			Data:  session.Id,
+		})
+	})
+}
+
+// 结束广播，恢复原来的路由
+// 调用时必须持有 routes 和 Broadcasts.lock
+func (manager *ClientManager) endBroadcast(session *BroadcastSession) {
+	delete(manager.Broadcasts.sessions, session.Id)
+	if session.timer != nil {
+		session.timer.Stop()
+	}
+
+	for _, client := range session.conn.StopBroadcasting() {
+		client.leaveBroadcast()
+	}
+
+	// 连接实例是为这次广播建的，没有别的路由了
+	if len(manager.Router.RoutesFrom(session.From)) == 0 {
+		if conn, ok := manager.Router.Connection(session.From); ok && conn == session.conn {
+			manager.Router.RemoveConnection(session.From)
+			manager.Pending.CancelFrom(session.From)
+			conn.Stop()
+		}
+	}
+	logger.Info("broadcast stopped", logger.F("broadcastid", session.Id))
+}
+
+// 设备上线，加入所有在等它的广播
+// 调用时必须持有 routes
+func (manager *ClientManager) notifyBroadcast(client *Client) {
+	b := manager.Broadcasts
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, session := range b.sessions {
+		for _, key := range session.To {
+			if key == client.Key {
+				client.joinBroadcast()
+				session.conn.AddBroadcastClient(client)
+				break
+			}
+		}
+	}
+}
+
+// 正在进行的广播，按id排序，用于上报
+func (manager *ClientManager) BroadcastList() []BroadcastSession {
+	b := manager.Broadcasts
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	list := make([]BroadcastSession, 0, len(b.sessions))
+	for _, session := range b.sessions {
+		list = append(list, BroadcastSession{
+			Id:       session.Id,
+			From:     session.From,
+			To:       append([]string(nil), session.To...),
+			Deadline: session.Deadline,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"reflect"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// a在给x发数据，b、c在线，s10要a广播给b、c
+func newBroadcastManager(t *testing.T) (*ClientManager, map[string]*Client) {
+	manager := NewClientManager(config.Default())
+	clients := map[string]*Client{}
+	for _, key := range []string{"a", "b", "c", "x"} {
+		clients[key] = newBenchClient(key)
+		manager.Clients.Add(clients[key])
+	}
+	if err := manager.Connect("a", "x", RouteOptions{}); err != nil {
+		t.Fatalf("Connect(a, x): %v", err)
+	}
+	return manager, clients
+}
+
+// a发一帧数据，返回收到的设备
+func sendFrom(manager *ClientManager, clients map[string]*Client) []string {
+	conn, ok := manager.Router.Connection("a")
+	if !ok {
+		return nil
+	}
+	conn.forward("a", Frame{Type: websocket.TextMessage, Data: []byte("hi")})
+
+	var got []string
+	for _, key := range []string{"a", "b", "c", "x"} {
+		select {
+		case <-clients[key].Write:
+			got = append(got, key)
+		default:
+		}
+	}
+	return got
+}
+
+func broadcastIds(manager *ClientManager) []string {
+	ids := []string{}
+	for _, session := range manager.BroadcastList() {
+		ids = append(ids, session.Id)
+	}
+	return ids
+}
+
+// 用一个新的队列收集发给s10的指令，调用返回的函数换回原来的队列
+func captureOutCmds() (*commands.OutQueue, func()) {
+	old := commands.OutCmdQueue
+	queue := commands.NewOutQueue(10, commands.DropOldest, false, "")
+	commands.OutCmdQueue = queue
+	return queue, func() { commands.OutCmdQueue = old }
+}
+
+func TestBroadcastStop(t *testing.T) {
+	manager, clients := newBroadcastManager(t)
+
+	id, err := manager.StartBroadcast("bc1", "a", []string{"b", "c", "b"}, 0)
+	if err != nil || id != "bc1" {
+		t.Fatalf("StartBroadcast = %q, %v", id, err)
+	}
+	if _, err := manager.StartBroadcast("bc2", "a", []string{"x"}, 0); err == nil {
+		t.Fatal("a second broadcast from a was accepted")
+	}
+	if got := sendFrom(manager, clients); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("during the broadcast frames went to %v, want [b c]", got)
+	}
+
+	if err := manager.StopBroadcast("bc1"); err != nil {
+		t.Fatalf("StopBroadcast: %v", err)
+	}
+	if code, _ := commands.ErrorCode(manager.StopBroadcast("bc1")); code != commands.CodeBroadcastUnknown {
+		t.Fatalf("stopping a finished broadcast: code %d, want %d", code, commands.CodeBroadcastUnknown)
+	}
+	if got := sendFrom(manager, clients); !reflect.DeepEqual(got, []string{"x"}) {
+		t.Fatalf("after the broadcast frames went to %v, want the route a -> x back", got)
+	}
+	if clients["b"].BroadcastRecv() || clients["c"].BroadcastRecv() {
+		t.Fatal("receivers still marked as receiving a broadcast")
+	}
+}
+
+func TestBroadcastTimeout(t *testing.T) {
+	out, restore := captureOutCmds()
+	defer restore()
+	manager, clients := newBroadcastManager(t)
+	manager.Disconnect("a", "x")
+
+	// a没有别的路由，连接实例是为广播建的，超时后一起删除
+	if _, err := manager.StartBroadcast("bc1", "a", []string{"b"}, 20*time.Millisecond); err != nil {
+		t.Fatalf("StartBroadcast: %v", err)
+	}
+	if got := sendFrom(manager, clients); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("during the broadcast frames went to %v, want [b]", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(manager.BroadcastList()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcast did not time out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := manager.Router.Connection("a"); ok {
+		t.Fatal("connection made for the broadcast is still there")
+	}
+	item := out.Peek()
+	if item == nil || item.Cmd.Cmd != "broadcastend" || item.Cmd.Data != "bc1" {
+		t.Fatalf("s10 was told %+v, want broadcastend bc1", item)
+	}
+}
+
+func TestBroadcastExtend(t *testing.T) {
+	_, restore := captureOutCmds()
+	defer restore()
+	manager, _ := newBroadcastManager(t)
+
+	if _, err := manager.StartBroadcast("bc1", "a", []string{"b"}, 20*time.Millisecond); err != nil {
+		t.Fatalf("StartBroadcast: %v", err)
+	}
+	if err := manager.ExtendBroadcast("bc1", time.Hour); err != nil {
+		t.Fatalf("ExtendBroadcast: %v", err)
+	}
+	if code, _ := commands.ErrorCode(manager.ExtendBroadcast("bc2", time.Hour)); code != commands.CodeBroadcastUnknown {
+		t.Fatalf("extending an unknown broadcast: code %d, want %d", code, commands.CodeBroadcastUnknown)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ids := broadcastIds(manager); !reflect.DeepEqual(ids, []string{"bc1"}) {
+		t.Fatalf("broadcasts after the old timeout = %v, want [bc1]", ids)
+	}
+	list := manager.BroadcastList()
+	if left := time.Duration(list[0].Deadline-time.Now().UnixNano()/int64(time.Millisecond)) * time.Millisecond; left < 59*time.Minute {
+		t.Fatalf("deadline is %v away, want about an hour", left)
+	}
+}
+
+// 接收广播的设备断线重连，新的会话接着接收广播，广播结束后恢复原来的路由
+func TestBroadcastReceiverReconnects(t *testing.T) {
+	manager, clients := newBroadcastManager(t)
+	if err := manager.Connect("a", "b", RouteOptions{Persist: true}); err != nil {
+		t.Fatalf("Connect(a, b): %v", err)
+	}
+	if _, err := manager.StartBroadcast("bc1", "a", []string{"b"}, 0); err != nil {
+		t.Fatalf("StartBroadcast: %v", err)
+	}
+
+	old := clients["b"]
+	manager.Clients.Remove(old)
+	old.markClosed()
+	manager.releaseRoutes(old)
+
+	clients["b"] = newBenchClient("b")
+	manager.Clients.Add(clients["b"])
+	manager.routes.Lock()
+	manager.Pending.Notify(clients["b"])
+	manager.notifyBroadcast(clients["b"])
+	manager.routes.Unlock()
+
+	if got := sendFrom(manager, clients); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("after b reconnected frames went to %v, want only the broadcast to b", got)
+	}
+	if err := manager.StopBroadcast("bc1"); err != nil {
+		t.Fatalf("StopBroadcast: %v", err)
+	}
+	if clients["b"].BroadcastRecv() {
+		t.Fatal("new session of b still marked as receiving a broadcast")
+	}
+	if got := sendFrom(manager, clients); !reflect.DeepEqual(got, []string{"b", "x"}) {
+		t.Fatalf("after the broadcast frames went to %v, want [b x]", got)
+	}
+}
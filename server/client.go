@@ -1,55 +1,353 @@
 package server
 
-import "github.com/gorilla/websocket"
+import (
+	"sanji_s12/config"
+	"sanji_s12/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 // 一个设备连接进来就实例化一个client
 type Client struct {
-	DeviceId      string          `json:"-"`
-	DeviceType    string          `json:"device_type"` // 设备类型 1:winapp,2:deviceapp，3:phoneapp, 4:s2
-	Key           string          `json:"key"`         // 设备key 作为设备的唯一标识
-	Mac           string          `json:"mac"`
-	IP            string          `json:"ip"`
-	Socket        *websocket.Conn `json:"socket"`
-	Read          chan []byte     `json:"-"`
-	Write         chan []byte     `json:"-"`
-	Tm            int64           `json:"tm"` //最后一次通话的时间 毫秒
-	BroadcastRecv bool            `json:"-"`  //是否在接受广播
-	CloseChan     chan struct{}   `json:"-"`
+	DeviceId    string          `json:"-"`
+	DeviceType  string          `json:"device_type"` // 设备类型 1:winapp,2:deviceapp，3:phoneapp, 4:s2
+	Key         string          `json:"key"`         // 设备key 作为设备的唯一标识
+	Mac         string          `json:"mac"`
+	IP          string          `json:"ip"`
+	Socket      *websocket.Conn `json:"socket"`
+	Read        chan Frame      `json:"-"`
+	Write       chan Frame      `json:"-"`
+	Tm          int64           `json:"tm"`           //最后一次通话的时间 毫秒
+	CloseChan   chan struct{}   `json:"-"`            // 设备下线后关闭，Read和Write都不会再关闭
+	WritePolicy string          `json:"write_policy"` // 写队列满了之后的处理方式
+
+	manager       *ClientManager
+	counters      *clientCounters
+	broadcastRecv int32 // 在接收几个广播
+	forwarding    int32 // 有几个转发数据的协程在读Read，见 deliver
+	closeOnce     sync.Once
+}
+
+// 设备的计数
+type clientCounters struct {
+	dropped  int64 // 因为写队列满了而丢掉的数据帧
+	unrouted int64 // 设备发来的、没有路由转发而丢掉的数据帧
+	stalled  int64 // 设备发来的、有路由但转发的协程等了WriteWait还没取走而丢掉的数据帧
+	kicked   int32 // 是否已经因为跟不上而被断开
+}
+
+// 上报s10时设备的信息
+type ClientStatus struct {
+	DeviceType  string `json:"device_type"`
+	Key         string `json:"key"`
+	Mac         string `json:"mac"`
+	IP          string `json:"ip"`
+	Tm          int64  `json:"tm"`
+	WritePolicy string `json:"write_policy"`
+	Dropped     int64  `json:"dropped"`  // 丢掉的数据帧数
+	Unrouted    int64  `json:"unrouted"` // 设备发来但没有路由转发的数据帧数
+	Stalled     int64  `json:"stalled"`  // 设备发来但转发跟不上而丢掉的数据帧数
+}
+
+func (c *Client) Status() ClientStatus {
+	return ClientStatus{
+		DeviceType:  c.DeviceType,
+		Key:         c.Key,
+		Mac:         c.Mac,
+		IP:          c.IP,
+		Tm:          c.LastTalk(),
+		WritePolicy: c.WritePolicy,
+		Dropped:     c.Dropped(),
+		Unrouted:    c.Unrouted(),
+		Stalled:     c.Stalled(),
+	}
+}
+
+// 因为写队列满了而丢掉的数据帧数
+func (c *Client) Dropped() int64 {
+	if c.counters == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.counters.dropped)
+}
+
+// 设备发来但没有路由转发而丢掉的数据帧数
+func (c *Client) Unrouted() int64 {
+	if c.counters == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.counters.unrouted)
+}
+
+// 设备发来但转发的协程跟不上而丢掉的数据帧数
+func (c *Client) Stalled() int64 {
+	if c.counters == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.counters.stalled)
+}
+
+// 设备是否在线
+func (c *Client) Online() bool {
+	select {
+	case <-c.CloseChan:
+		return false
+	default:
+		return true
+	}
+}
+
+// 标记设备已经下线，读写协程和转发数据的协程都会收到信号
+// 只有第一次调用生效
+func (c *Client) markClosed() {
+	c.closeOnce.Do(func() {
+		close(c.CloseChan)
+	})
+}
+
+// 设备是否在接收广播
+func (c *Client) BroadcastRecv() bool {
+	return atomic.LoadInt32(&c.broadcastRecv) > 0
+}
+
+// 开始接收一次广播，一个设备可以同时接收多个广播
+func (c *Client) joinBroadcast() {
+	atomic.AddInt32(&c.broadcastRecv, 1)
+}
+
+func (c *Client) leaveBroadcast() {
+	atomic.AddInt32(&c.broadcastRecv, -1)
+}
+
+// 把数据放到设备的写队列中
+// 队列满了的时候按WritePolicy处理，返回数据是否进了队列
+// 设备已经下线时直接丢掉数据，返回false
+func (c *Client) Send(data Frame) bool {
+	if !c.Online() {
+		return false
+	}
+	switch c.WritePolicy {
+	case config.WritePolicyDropNewest:
+		select {
+		case c.Write <- data:
+			return true
+		default:
+			c.drop()
+			return false
+		}
+	case config.WritePolicyDropOldest:
+		for {
+			select {
+			case c.Write <- data:
+				return true
+			default:
+			}
+			// 腾出一个位置
+			select {
+			case <-c.Write:
+				c.drop()
+			default:
+			}
+		}
+	case config.WritePolicyDisconnect:
+		select {
+		case c.Write <- data:
+			return true
+		default:
+			c.drop()
+			c.kick()
+			return false
+		}
+	default:
+		select {
+		case c.Write <- data:
+			return true
+		case <-c.CloseChan:
+			return false
+		}
+	}
+}
+
+// 把一条通知放到设备的写队列中
+// 不管WritePolicy，队列满了就丢掉这条通知：通知不能阻塞发送它的协程，也不应该因此断开设备
+func (c *Client) offer(data Frame) bool {
+	if !c.Online() {
+		return false
+	}
+	select {
+	case c.Write <- data:
+		return true
+	default:
+		c.drop()
+		return false
+	}
+}
+
+func (c *Client) drop() {
+	if c.counters != nil {
+		atomic.AddInt64(&c.counters.dropped, 1)
+	}
+	if c.manager != nil {
+		c.manager.metrics.dropped.Inc(c.DeviceType)
+	}
+}
+
+// 断开跟不上的设备，读协程会因此退出并注销这个设备
+func (c *Client) kick() {
+	if c.counters == nil || !atomic.CompareAndSwapInt32(&c.counters.kicked, 0, 1) {
+		return
+	}
+	logger.Warn("device is too slow, disconnect it", logger.Key(c.Key), logger.F("devicetype", c.DeviceType))
+	c.Socket.Close()
+}
+
+// 发给设备的关闭帧的状态码，4000以上由应用自己定义
+const (
+	CloseReplaced     = 4001 // 同一个key有新的连接，原来的连接被顶掉
+	CloseDuplicateKey = 4002 // 同一个key已经在线，拒绝新的连接
+)
+
+// 向设备发送带原因的关闭帧，然后断开
+func (c *Client) closeWith(code int, reason string) {
+	c.closeBefore(code, reason, time.Now().Add(c.manager.Config.WriteWait.Duration))
+}
+
+// 和 closeWith 一样，关闭帧最晚在deadline之前写完
+func (c *Client) closeBefore(code int, reason string, deadline time.Time) {
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := c.Socket.WriteControl(websocket.CloseMessage, message, deadline); err != nil {
+		logger.Debug("can't send close frame", logger.Key(c.Key), logger.Err(err))
+	}
+	c.Socket.Close()
+}
+
+// 更新最后一次通话的时间
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.Tm, time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+// 最后一次通话的时间 毫秒
+func (c *Client) LastTalk() int64 {
+	return atomic.LoadInt64(&c.Tm)
 }
 
 // 从连接中读取数据
+// 超过PongWait没有收到任何数据（包括pong）就认为设备已经掉线
 func (c *Client) read() {
 	defer func() {
-		Manager.Unregister <- c
+		c.manager.Unregister <- c
 		c.Socket.Close()
 	}()
 
+	pongWait := c.manager.Config.PongWait.Duration
+	c.touch()
+	c.Socket.SetReadDeadline(time.Now().Add(pongWait))
+	c.Socket.SetPongHandler(func(string) error {
+		c.touch()
+		return c.Socket.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
-		_, message, err := c.Socket.ReadMessage()
+		msgType, message, err := c.Socket.ReadMessage()
 		if err != nil {
-			Manager.Unregister <- c
-			c.Socket.Close()
+			logger.Info("device offline", logger.Key(c.Key), logger.F("devicetype", c.DeviceType), logger.Err(err))
 			break
 		}
-		c.Read <- message
+		c.touch()
+		c.Socket.SetReadDeadline(time.Now().Add(pongWait))
+		if !c.deliver(Frame{Type: msgType, Data: message}) {
+			return
+		}
+	}
+}
+
+// 把读到的一帧交给转发数据的协程，设备已经下线时返回false
+// 读协程不能一直阻塞在这里，否则不再调用ReadMessage，收不到pong和关闭帧，设备掉线也发现不了：
+// 没有路由在转发这个设备的数据时直接丢掉，记为unrouted；
+// 转发的协程跟不上时（比如接收方按block策略写不进去）最多等WriteWait，之后丢掉，记为stalled
+func (c *Client) deliver(frame Frame) bool {
+	select {
+	case c.Read <- frame:
+		return true
+	case <-c.CloseChan:
+		return false
+	default:
+	}
+
+	if atomic.LoadInt32(&c.forwarding) > 0 {
+		timer := time.NewTimer(c.manager.Config.WriteWait.Duration)
+		defer timer.Stop()
+		select {
+		case c.Read <- frame:
+			return true
+		case <-c.CloseChan:
+			return false
+		case <-timer.C:
+			if c.counters != nil {
+				atomic.AddInt64(&c.counters.stalled, 1)
+			}
+			c.manager.metrics.stalled.Inc(c.DeviceType)
+			return true
+		}
 	}
+
+	if c.counters != nil {
+		atomic.AddInt64(&c.counters.unrouted, 1)
+	}
+	c.manager.metrics.unrouted.Inc(c.DeviceType)
+	return true
 }
 
-// 向设备写入数据
+// 转发数据的协程开始、停止读这个设备的数据
+func (c *Client) startForwarding() { atomic.AddInt32(&c.forwarding, 1) }
+func (c *Client) stopForwarding()  { atomic.AddInt32(&c.forwarding, -1) }
+
+// 向设备写入数据，并定时发送ping
 func (c *Client) write() {
+	ticker := time.NewTicker(c.manager.Config.PingInterval.Duration)
 	defer func() {
+		ticker.Stop()
 		c.Socket.Close()
 	}()
 
+	writeWait := c.manager.Config.WriteWait.Duration
+	// 写失败后关闭socket，读协程会因此退出并注销这个设备
+	// 在设备下线之前继续把数据取走，避免转发数据的协程阻塞
+	broken := false
+
 	for {
 		select {
-		case message, ok := <-c.Write:
-			if !ok {
-				c.Socket.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.CloseChan:
+			c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Socket.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.Write:
+			if broken {
+				continue
 			}
 
-			c.Socket.WriteMessage(websocket.BinaryMessage, message)
+			c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+			msgType := message.Type
+			if msgType == 0 {
+				msgType = websocket.BinaryMessage
+			}
+			if err := c.Socket.WriteMessage(msgType, message.Data); err != nil {
+				logger.Warn("can't write to device", logger.Key(c.Key), logger.Err(err))
+				broken = true
+				c.Socket.Close()
+			}
+		case <-ticker.C:
+			if broken {
+				continue
+			}
+			if err := c.Socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				logger.Warn("can't ping device", logger.Key(c.Key), logger.Err(err))
+				broken = true
+				c.Socket.Close()
+			}
 		}
 	}
 }
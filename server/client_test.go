@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sanji_s12/config"
+	"testing"
+	"time"
+)
+
+// 读协程交出一帧数据时，按有没有路由、转发跟不跟得上分别计数
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarding bool // 有转发数据的协程在读
+		reading    bool // 转发数据的协程正在等数据
+		unrouted   int64
+		stalled    int64
+	}{
+		{name: "forwarded", forwarding: true, reading: true},
+		{name: "no route", unrouted: 1},
+		{name: "forwarder busy", forwarding: true, stalled: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.Default()
+			conf.WriteWait.Duration = 10 * time.Millisecond
+			client := newBenchClient("a")
+			client.Read = make(chan Frame)
+			client.manager = NewClientManager(conf)
+			if tt.forwarding {
+				client.startForwarding()
+			}
+			got := make(chan Frame, 1)
+			if tt.reading {
+				go func() { got <- <-client.Read }()
+			}
+
+			if !client.deliver(Frame{Data: []byte("hi")}) {
+				t.Fatal("deliver reported the device offline")
+			}
+			if tt.reading {
+				<-got
+			}
+			if client.Unrouted() != tt.unrouted || client.Stalled() != tt.stalled {
+				t.Fatalf("unrouted, stalled = %d, %d, want %d, %d", client.Unrouted(), client.Stalled(), tt.unrouted, tt.stalled)
+			}
+		})
+	}
+}
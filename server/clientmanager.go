@@ -1,24 +1,59 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sanji_s12/commands"
+	"sanji_s12/config"
+	"sanji_s12/logger"
+	"sanji_s12/metrics"
 	"sanji_s12/util"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // 连接管理器
 // 这个管理器，需要处理各种指令
 // 需要管理设备上线下线的情况
 type ClientManager struct {
-	Clients    map[*Client]bool
-	Broadcast  chan []byte
+	Clients    *Registry    // 在线的设备
 	Register   chan *Client // 设备连接
 	Unregister chan *Client // 设备下线
-	Lock       sync.Mutex
+	Config     *config.Config
+	Pending    *PendingRoutes     // 等待设备上线的路由
+	Router     *Router            // 路由状态
+	Broadcasts *BroadcastSessions // 正在进行的广播
+	Metrics    *metrics.Registry  // /metrics输出的指标，main中还会加上与s10连接的指标
+
+	metrics *serverMetrics
+	local   chan localCommand // 管理接口发起的指令，见 Exec
+	closing int32             // 正在关闭，不再接受新的设备连接
+
+	// 修改路由时持有，路由表、连接实例和等待表要一起改
+	// 指令、设备上下线和广播超时在不同的协程中，都会修改路由
+	routes sync.Mutex
+}
+
+// 按配置实例化连接管理器
+func NewClientManager(conf *config.Config) *ClientManager {
+	manager := &ClientManager{
+		Register:   make(chan *Client),
+		Unregister: make(chan *Client),
+		Clients:    NewRegistry(),
+		Config:     conf,
+		Pending:    NewPendingRoutes(),
+		Router:     NewRouter(),
+		Broadcasts: NewBroadcastSessions(),
+		Metrics:    metrics.NewRegistry(),
+		metrics:    newServerMetrics(),
+		local:      make(chan localCommand),
+	}
+	manager.Metrics.Register(manager)
+	return manager
 }
 
 // 开始处理连接
@@ -28,12 +63,25 @@ func (manager *ClientManager) Start() {
 		select {
 		// 设备上线
 		case conn := <-manager.Register:
-			fmt.Println("a new connect has arrived: ", conn.Key)
-			manager.Lock.Lock()
-			manager.Clients[conn] = true
-			manager.Lock.Unlock()
+			replaced, ok := manager.admit(conn)
+			if !ok {
+				continue
+			}
+			manager.Clients.Add(conn)
+			logger.Info("device online", logger.Key(conn.Key), logger.F("devicetype", conn.DeviceType))
+
+			// 新的会话已经在线，顶掉的会话的路由转到它上面，和DuplicateKeyMulti下一个会话下线时一样
+			for _, old := range replaced {
+				logger.Warn("key connected again, kick the old connection", logger.Key(old.Key))
+				old.closeWith(CloseReplaced, "replaced by a new connection")
+				manager.removeClient(old)
+			}
 
-			fmt.Println("a new client has joined: ", conn.Key)
+			// 接上等待这个设备上线的路由和广播
+			manager.routes.Lock()
+			manager.Pending.Notify(conn)
+			manager.notifyBroadcast(conn)
+			manager.routes.Unlock()
 
 			jsonMessage, _ := json.Marshal(&Message{Content: "/A new socket has connected. The key is: " + conn.Key})
 			manager.send(jsonMessage, conn)
@@ -43,162 +91,370 @@ func (manager *ClientManager) Start() {
 
 		// 设备下线
 		case conn := <-manager.Unregister:
-			if _, ok := manager.Clients[conn]; ok {
-				close(conn.Read)
-				close(conn.Write)
-				delete(manager.Clients, conn)
-				jsonMessage, _ := json.Marshal(&Message{Content: "/A socket has disconnected."})
-				manager.send(jsonMessage, conn)
-
-				// 处理路由表 key=fromKey key=toKey
-				manager.HandleOffline(conn.Key)
-
-				// TODO：生成一条report指令，放到writeCmdChan中
-				manager.Report(conn, "offline")
-			}
-		case message := <-manager.Broadcast:
-			for conn := range manager.Clients {
-				select {
-				case conn.Read <- message:
-				default:
-					close(conn.Read)
-					close(conn.Write)
-					delete(manager.Clients, conn)
-				}
-			}
+			manager.removeClient(conn)
 		}
 	}
 }
 
-func (manager *ClientManager) CheckClientExist(key string) (*Client, bool) {
-	manager.Lock.Lock()
-	for client, ok := range manager.Clients {
-		if ok {
-			if client.Key == key {
-				return client, ok
-			}
-		}
+// 按DuplicateKeyPolicy处理同一个key重复连接的情况
+// 返回要被新连接顶掉的会话，以及是否接受这个新的连接
+// 顶掉的会话要等新的会话加入之后再注销，这样它的路由会转到新的会话上，而不是按下线处理
+func (manager *ClientManager) admit(conn *Client) ([]*Client, bool) {
+	sessions := manager.Clients.Sessions(conn.Key)
+	if len(sessions) == 0 {
+		return nil, true
 	}
-	manager.Lock.Unlock()
-	return nil, false
+
+	switch manager.Config.DuplicateKeyPolicy {
+	case config.DuplicateKeyReject:
+		logger.Warn("key is already online, reject the new connection", logger.Key(conn.Key))
+		manager.metrics.rejections.Inc(RejectDuplicateKey)
+		conn.closeWith(CloseDuplicateKey, "key is already online")
+		conn.markClosed()
+		return nil, false
+	case config.DuplicateKeyKick:
+		return sessions, true
+	}
+	return nil, true
+}
+
+// 注销一个设备会话
+// 读协程退出、被新连接顶掉、写队列跟不上时都会走到这里，重复调用没有影响
+func (manager *ClientManager) removeClient(conn *Client) {
+	if !manager.Clients.Remove(conn) {
+		return
+	}
+	conn.Socket.Close()
+	conn.markClosed()
+	jsonMessage, _ := json.Marshal(&Message{Content: "/A socket has disconnected."})
+	manager.send(jsonMessage, conn)
+
+	if !manager.releaseRoutes(conn) {
+		// 这个key没有下线，不向s10报offline
+		return
+	}
+
+	// TODO：生成一条report指令，放到writeCmdChan中
+	manager.Report(conn, "offline")
+}
+
+// 处理已经注销的会话用到的路由 key=fromKey key=toKey
+// 返回这个key是否已经下线，同一个key还有别的会话在线时路由转到最新的会话上
+func (manager *ClientManager) releaseRoutes(conn *Client) bool {
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	if current, ok := manager.Clients.Get(conn.Key); ok {
+		manager.moveRoutes(conn, current)
+		return false
+	}
+	manager.HandleOffline(conn.Key)
+	return true
+}
+
+// 找到key对应的在线设备，同一个key有多个会话时返回最新的一个
+func (manager *ClientManager) CheckClientExist(key string) (*Client, bool) {
+	return manager.Clients.Get(key)
 }
 
 // 设备离线的情况，作为收发设备具有不同的处理方式
+// conn指令带了persist的路由进入等待状态，留在路由表中，设备重新上线后自动接上
+// 其余的路由直接删除
+// 调用时必须持有 routes
 func (manager *ClientManager) HandleOffline(key string) {
 
 	// 一个设备可以同是接收数据和发送数据
-	// 如果它在发送数据
-	// 就把这个Connection在ConnectionMap中删除
-	for connKey := range ConnectionMap {
-		if connKey == key {
-			ConnectionMap[connKey].DisconnectChan <- struct{}{}
-			close(ConnectionMap[connKey].DisconnectChan)
-			delete(ConnectionMap, connKey)
+	// 如果它在发送数据，转发数据的协程会因为设备下线自己退出
+	if conn, ok := manager.Router.Connection(key); ok {
+		conn.SetReadClient(nil)
+		for _, toKey := range manager.Router.RoutesFrom(key) {
+			if !conn.OptionsFor(toKey).Persist {
+				manager.dropRoute(key, toKey)
+			}
+		}
+		// 还有路由留下来，等它重新上线
+		if current, ok := manager.Router.Connection(key); ok && current == conn {
+			manager.WaitForFromKey(conn, key)
 		}
 	}
 
-	// 遍历一下routetable, 查找一下它在哪个连接中接收数据
-	for fromKey, conns := range RouteTable {
-		for _, conn := range conns {
-			if conn == key {
-				ConnectionMap[fromKey].DeleteWriteClient(key)
-			}
+	// 查找一下它在哪个连接中接收数据
+	for _, fromKey := range manager.Router.RoutesTo(key) {
+		conn, ok := manager.Router.Connection(fromKey)
+		if !ok {
+			continue
+		}
+		if conn.OptionsFor(key).Persist {
+			conn.DeleteWriteClient(key)
+			manager.WaitForToKey(conn, fromKey, key)
+		} else {
+			manager.dropRoute(fromKey, key)
+		}
+	}
+}
+
+// 同一个key的一个会话下线了，但还有别的会话在线（DuplicateKeyMulti）
+// 用到下线会话的路由换到current上，路由本身保持不变
+// 调用时必须持有 routes
+func (manager *ClientManager) moveRoutes(old, current *Client) {
+	if conn, ok := manager.Router.Connection(old.Key); ok && conn.readClient() == old {
+		conn.SetReadClient(current)
+		go conn.TransData()
+	}
+	for _, fromKey := range manager.Router.RoutesTo(old.Key) {
+		if conn, ok := manager.Router.Connection(fromKey); ok {
+			conn.ReplaceWriteClient(old, current)
 		}
 	}
 }
 
 // 处理s10发给s12的指令
+// 每条指令执行完都回复一条ack指令，CmdId与原指令相同
 func (manager *ClientManager) HandleCommand() {
 	for {
 		select {
 		case cmd := <-commands.InCmdChan:
-			switch cmd.Cmd {
-			case "set":
-				// set指令是接收s10发送过来的key，这个key会变的吗？
-				// 将这个key存到系统的内存中
-				key := cmd.Data
-				commands.S12Key = key
-			case "conn":
-				// connect微指令，s10告知s12要为哪两台设备搭建一条收发数据的管道
-				// 建立管道的流程就像是建立一个聊天室，只不过这个聊天室比较特殊：
-				// 只有两个人
-				// 一个在不停地说话， 一个在不停地接收
-				// 需求：如何搭建这个管道，可以快速地找到并关闭
-				//fromKey := cmd.From
-				//toKey := cmd.To
-				// 为这两个key建立一条管道，如何建立才能方便断开
-				// 如何管理这些管道
-				// 1 从fromKey中读数据，然后写到toKey中
-				//go EstabilshPipe(fromKey, toKey)
-				manager.Connect(cmd.From, cmd.To)
-			case "disconn":
-				// 把connect指令建立的map断开
-				//fromKey := cmd.From
-				//toKey := cmd.To
-				manager.Disconnect(cmd.From, cmd.To)
-			case "reset":
-				// 重置所有连接，保留data字段内的连接，其余的都关闭
-				manager.Reset(cmd.Data)
-			case "close":
-				// 关闭data字段内的连接
-				manager.Close(cmd.Data)
-			case "accept":
-				// s10告知s12哪个设备可以连接
-				key := cmd.Data
-				commands.PermissionKey = append(commands.PermissionKey, key)
-			case "report":
-				fmt.Println("report!!!!!!!!!!")
-				manager.ReportAll()
-			case "broadcast":
-				manager.HandleBroadcast(cmd.From, cmd.To)
-			default:
-				fmt.Println("Don't know what command it is.")
+			if cmd.Cmd == "ack" {
+				// s10对s12上报的回复，不需要再回复
+				continue
+			}
+			data, err := manager.ExecCommand(cmd)
+			manager.metrics.command(cmd.Cmd, err)
+			if err != nil {
+				logger.Warn("command failed", logger.Cmd(cmd.Cmd), logger.CmdId(cmd.CmdId), logger.ErrKeys(err, cmdKeys(cmd)...))
 			}
+			reply := commands.Reply(cmd, err)
+			reply.Data = data
+			commands.OutCmdQueue.Push(reply)
+		case req := <-manager.local:
+			data, err := manager.ExecCommand(req.cmd)
+			req.reply <- localResult{data, err}
 		}
 	}
 }
 
-// 等待toKey设备上线
-func (manager *ClientManager) WaitForToKey(conn *Connection, key string) {
+// 指令中可能出现在错误信息里的设备key：from、to，以及close、accept、reset等指令的data
+// to和data可能是用逗号分开的多个key或者from=to
+func cmdKeys(cmd commands.Cmd) []string {
+	keys := []string{cmd.From}
+	for _, value := range []string{cmd.To, cmd.Data} {
+		for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '=' }) {
+			keys = append(keys, strings.TrimSpace(part))
+		}
+	}
+	return keys
+}
+
+// s12本地发起的一条指令，执行结果不回复s10，而是通过reply返回
+type localCommand struct {
+	cmd   commands.Cmd
+	reply chan localResult
+}
 
-	found := false
+type localResult struct {
+	data string
+	err  error
+}
 
-	for {
-		manager.Lock.Lock()
-		for client, _ := range manager.Clients {
-			if client.Key == key {
-				fmt.Println("找到设备：", key)
-				conn.AddWriteClient(*client)
-				found = true
+// 执行一条本地发起的指令，比如来自管理接口
+// 指令交给HandleCommand的协程执行，和s10的指令排队
+func (manager *ClientManager) Exec(ctx context.Context, cmd commands.Cmd) (string, error) {
+	req := localCommand{cmd: cmd, reply: make(chan localResult, 1)}
+	select {
+	case manager.local <- req:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	select {
+	case result := <-req.reply:
+		return result.data, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// 执行一条s10下发的指令
+// 返回的字符串放在ack指令的data字段中带给s10，大多数指令为空
+func (manager *ClientManager) ExecCommand(cmd commands.Cmd) (string, error) {
+	switch cmd.Cmd {
+	case "set":
+		// set指令是接收s10发送过来的key，这个key会变的吗？
+		// 将这个key存到系统的内存中
+		if cmd.Data == "" {
+			return "", commands.Errorf(commands.CodeBadData, "set: data is empty")
+		}
+		commands.SetS12Key(cmd.Data)
+	case "conn":
+		// connect微指令，s10告知s12要为哪两台设备搭建一条收发数据的管道
+		// 建立管道的流程就像是建立一个聊天室，只不过这个聊天室比较特殊：
+		// 只有两个人
+		// 一个在不停地说话， 一个在不停地接收
+		// 需求：如何搭建这个管道，可以快速地找到并关闭
+		// 为这两个key建立一条管道，如何建立才能方便断开
+		// 如何管理这些管道
+		// 1 从fromKey中读数据，然后写到toKey中
+		if cmd.From == "" || cmd.To == "" {
+			return "", commands.Errorf(commands.CodeBadData, "conn: from and to are required")
+		}
+		msgType, err := ParseMsgType(cmd.MsgType)
+		if err != nil {
+			return "", err
+		}
+		return "", manager.Connect(cmd.From, cmd.To, RouteOptions{MsgType: msgType, Persist: cmd.Persist, Envelope: cmd.Envelope, Duplex: cmd.Duplex})
+	case "disconn":
+		// 把connect指令建立的map断开
+		if cmd.From == "" || cmd.To == "" {
+			return "", commands.Errorf(commands.CodeBadData, "disconn: from and to are required")
+		}
+		return "", manager.Disconnect(cmd.From, cmd.To)
+	case "reset":
+		// 重置所有连接，保留data字段内的连接，其余的都关闭
+		results, err := manager.Reset(cmd.Data)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(results)
+		return string(data), err
+	case "close":
+		// 关闭data字段内的连接
+		if cmd.Data == "" {
+			return "", commands.Errorf(commands.CodeBadData, "close: data is empty")
+		}
+		return "", manager.Close(cmd.Data)
+	case "accept":
+		// s10告知s12哪个设备可以连接
+		if cmd.Data == "" {
+			return "", commands.Errorf(commands.CodeBadData, "accept: data is empty")
+		}
+		commands.AllowKey(cmd.Data)
+	case "revoke":
+		// 不再允许这个key连接，已经在线的设备用close指令断开
+		if cmd.Data == "" {
+			return "", commands.Errorf(commands.CodeBadData, "revoke: data is empty")
+		}
+		if !commands.RevokeKey(cmd.Data) {
+			return "", commands.Errorf(commands.CodeKeyUnknown, "key %s is not accepted", cmd.Data)
+		}
+	case "report":
+		manager.ReportAll()
+	case "routes":
+		// s10下发的权威路由表，与本地的路由表对齐
+		results, err := manager.SyncRoutes(cmd.Data)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(results)
+		return string(data), err
+	case "broadcast":
+		// 开始一次广播，ack指令的data带上广播的id
+		if cmd.From == "" || cmd.To == "" {
+			return "", commands.Errorf(commands.CodeBadData, "broadcast: from and to are required")
+		}
+		toKeys := strings.Split(cmd.To, ",")
+		for index, key := range toKeys {
+			toKeys[index] = strings.TrimSpace(key)
+			if toKeys[index] == "" {
+				return "", commands.Errorf(commands.CodeBadData, "broadcast: malformed to %q", cmd.To)
 			}
 		}
-		manager.Lock.Unlock()
-		if found {
-			break
+		if cmd.Timeout < 0 {
+			return "", commands.Errorf(commands.CodeBadData, "broadcast: timeout must not be negative")
+		}
+		timeout := manager.Config.BroadcastTimeout.Duration
+		if cmd.Timeout > 0 {
+			timeout = time.Duration(cmd.Timeout) * time.Second
+		}
+		return manager.StartBroadcast(cmd.BroadcastId, cmd.From, toKeys, timeout)
+	case "notify":
+		// 系统通知，data原样发给设备，devicetype不为空时只发给这一类设备
+		if cmd.Data == "" {
+			return "", commands.Errorf(commands.CodeBadData, "notify: data is empty")
+		}
+		msgType, err := ParseMsgType(cmd.MsgType)
+		if err != nil {
+			return "", err
+		}
+		if msgType == 0 {
+			msgType = websocket.TextMessage
 		}
+		delivered, dropped := manager.Notify(cmd.DeviceType, Frame{Type: msgType, Data: []byte(cmd.Data)})
+		data, err := json.Marshal(map[string]int{"delivered": delivered, "dropped": dropped})
+		return string(data), err
+	case "stopbroadcast":
+		if cmd.BroadcastId == "" {
+			return "", commands.Errorf(commands.CodeBadData, "stopbroadcast: broadcastid is required")
+		}
+		return "", manager.StopBroadcast(cmd.BroadcastId)
+	case "extendbroadcast":
+		if cmd.BroadcastId == "" || cmd.Timeout <= 0 {
+			return "", commands.Errorf(commands.CodeBadData, "extendbroadcast: broadcastid and a positive timeout are required")
+		}
+		return "", manager.ExtendBroadcast(cmd.BroadcastId, time.Duration(cmd.Timeout)*time.Second)
+	case "loglevel":
+		// 运行中修改日志级别，data为debug, info, warn, error，ack指令的data带上修改后的级别
+		level, err := logger.ParseLevel(cmd.Data)
+		if err != nil {
+			return "", commands.Errorf(commands.CodeBadData, "loglevel: %v", err)
+		}
+		logger.SetLevel(level)
+		logger.Info("log level changed", logger.F("loglevel", level.String()))
+		return level.String(), nil
+	default:
+		return "", commands.Errorf(commands.CodeUnknownCmd, "unknown command %q", cmd.Cmd)
 	}
+	return "", nil
 }
 
-// 等待fromKey设备的上线
-func (manager *ClientManager) WaitForFromKey(conn *Connection, key string) {
+// 等待toKey设备上线
+// 不再轮询设备列表，而是登记到等待表中，由Register时通知
+func (manager *ClientManager) WaitForToKey(conn *Connection, fromKey, toKey string) {
+	manager.Pending.Wait(fromKey, toKey, false, manager.Config.PendingRouteTimeout.Duration,
+		func(client *Client) {
+			logger.Info("route receiver online", logger.Route(fromKey, toKey))
+			conn.AddWriteClient(client)
+		},
+		func() {
+			manager.ReportStaleRoute(fromKey, toKey)
+		})
+
+	// 登记之前设备可能刚好上线了
+	if client, ok := manager.CheckClientExist(toKey); ok {
+		manager.Pending.Notify(client)
+	}
+}
 
-	found := false
+// 等待fromKey设备的上线
+func (manager *ClientManager) WaitForFromKey(conn *Connection, fromKey string) {
+	manager.Pending.Wait(fromKey, "", true, manager.Config.PendingRouteTimeout.Duration,
+		func(client *Client) {
+			logger.Info("route sender online", logger.Key(fromKey))
+			conn.SetReadClient(client)
+			go conn.TransData()
+		},
+		func() {
+			manager.ReportStaleRoute(fromKey, "")
+		})
+
+	if client, ok := manager.CheckClientExist(fromKey); ok {
+		manager.Pending.Notify(client)
+	}
+}
 
-	for {
-		manager.Lock.Lock()
-		for client, _ := range manager.Clients {
-			if client.Key == key {
-				fmt.Println("找到设备：", key)
-				conn.ReadClient = *client
-				go conn.TransData()
-				found = true
-			}
-		}
-		manager.Lock.Unlock()
-		if found {
-			break
-		}
+// 等待设备上线超时，告知s10这条路由一直没能接通
+// to 为空表示在等发送方上线
+func (manager *ClientManager) ReportStaleRoute(from, to string) {
+	report := commands.Cmd{
+		CmdId: util.GetCmdId(),
+		Cmd:   "routetimeout",
+		Role:  "client",
+		From:  from,
+		To:    to,
 	}
+
+	logger.Warn("route timed out waiting for device", logger.Route(from, to))
+
+	commands.OutCmdQueue.Push(report)
 }
 
 // 为两个设备建立连接
@@ -206,178 +462,261 @@ func (manager *ClientManager) WaitForFromKey(conn *Connection, key string) {
 // 2. 如果fromkey存在，tokey不存在。
 // 3. 如果fromkey不存在
 // RouterTable表fromkey里的值应该和该connection里的writeClients同步
-func (manager *ClientManager) Connect(fromKey string, toKey string) {
+// opts.Duplex为true时同时建立toKey到fromKey的路由，两个方向一起断开
+func (manager *ClientManager) Connect(fromKey string, toKey string, opts RouteOptions) error {
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	return manager.connect(fromKey, toKey, opts)
+}
+
+// 调用时必须持有 routes
+func (manager *ClientManager) connect(fromKey string, toKey string, opts RouteOptions) error {
+
+	// 先在路由表中记录这个路由
+	if opts.Duplex {
+		if fromKey == toKey {
+			return commands.Errorf(commands.CodeBadData, "duplex route needs two devices")
+		}
+		if !manager.Router.AddDuplex(fromKey, toKey) {
+			return commands.Errorf(commands.CodeRouteExists, "route %s <-> %s already exists", fromKey, toKey)
+		}
+		manager.attach(fromKey, toKey, opts)
+		manager.attach(toKey, fromKey, opts)
+		return nil
+	}
+
+	if !manager.Router.AddRoute(fromKey, toKey) {
+		return commands.Errorf(commands.CodeRouteExists, "route %s -> %s already exists", fromKey, toKey)
+	}
+	manager.attach(fromKey, toKey, opts)
+	return nil
+}
+
+// 路由表中已经有了fromKey到toKey的路由，为它接上设备
+// 设备不在线时等它上线
+// 路由的设置在接上设备、放进路由表之前存到连接实例中，转发和设备下线时都能读到
+func (manager *ClientManager) attach(fromKey string, toKey string, opts RouteOptions) {
 
 	// 如果fromkey存在且已经有在发送数据
 	// 找到tokey并发送数据
-	if conn, ok := ConnectionMap[fromKey]; ok {
+	if conn, ok := manager.Router.Connection(fromKey); ok {
+		conn.SetRouteOptions(toKey, opts)
 		// 在已经连接的设备中找到toKey
-		exist := false
-		for client, _ := range manager.Clients {
-			if client.Key == toKey {
-				exist = true
-				conn.AddWriteClient(*client)
-				RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
-				return
-			}
-		}
-
-		// 如果toKey还没连接上来
-		// 在路由表中先记录这个路由
-		// 等待这个设备上线，如何做这个等待(遍历clientmanager.Client)
-		if !exist {
-			RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
-			go manager.WaitForToKey(conn, toKey)
+		if client, ok := manager.CheckClientExist(toKey); ok {
+			conn.AddWriteClient(client)
 			return
 		}
-		// 上线后就向toKey发送数据
 
+		// 如果toKey还没连接上来
+		// 等待这个设备上线，上线后就向toKey发送数据
+		manager.WaitForToKey(conn, fromKey, toKey)
+		return
 	}
 
 	// 以下代码是处理connectionMap中没有fromKey的情况
 	// 如果connect指令发过来的时候，找到了fromKey, 但没有找到toKey
-	var readClient, writeClient Client
+	readClient, readOnline := manager.CheckClientExist(fromKey)
+	writeClient, writeOnline := manager.CheckClientExist(toKey)
+	logger.Debug("connecting", logger.Route(fromKey, toKey), logger.F("from_online", readOnline), logger.F("to_online", writeOnline))
 
-	for client, _ := range manager.Clients {
-		if client.Key == fromKey {
-			fmt.Println("Find from device")
-			readClient = *client
-		}
-		if client.Key == toKey {
-			fmt.Println("find to device")
-			writeClient = *client
-		}
-	}
-
-	if readClient.Key != "" { //说明找到了fromKey
-		if writeClient.Key != "" { // 也找到了tokey
-			RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
+	if readOnline { //说明找到了fromKey
+		if writeOnline { // 也找到了tokey
 			connection := Connection{
 				ReadClient:     readClient,
-				WriteClients:   []Client{writeClient},
+				WriteClients:   []*Client{writeClient},
 				DisconnectChan: make(chan struct{}, 1),
 			}
+			connection.SetRouteOptions(toKey, opts)
 
-			ConnectionMap[fromKey] = &connection
+			manager.Router.SetConnection(fromKey, &connection)
 
 			go connection.TransData()
-			go connection.ReportConnectStatus()
+			go connection.ReportConnectStatus(manager.Config.ConnReportInterval.Duration)
 		} else { // 找到fromKey, 但没有找到toKey
-			RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
 			// 如果没有找到这个fromkey
 			// 实例化连接
 			connection := Connection{
 				ReadClient:     readClient,
-				WriteClients:   []Client{},
+				WriteClients:   []*Client{},
 				DisconnectChan: make(chan struct{}, 1),
 			}
+			connection.SetRouteOptions(toKey, opts)
 
-			ConnectionMap[fromKey] = &connection
+			manager.Router.SetConnection(fromKey, &connection)
 
 			go connection.TransData()
-			go connection.ReportConnectStatus()
-			go manager.WaitForToKey(&connection, toKey)
+			go connection.ReportConnectStatus(manager.Config.ConnReportInterval.Duration)
+			manager.WaitForToKey(&connection, fromKey, toKey)
 		}
 		return
 	}
 
 	// 没有找到fromKey的情况
-	if readClient.Key == "" { // fromkey设备还没连接上来
-		if writeClient.Key != "" { // 但是tokey已经在线
-			RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
+	if !readOnline { // fromkey设备还没连接上来
+		if writeOnline { // 但是tokey已经在线
 			connection := Connection{
-				ReadClient:     Client{},
-				WriteClients:   []Client{writeClient},
+				WriteClients:   []*Client{writeClient},
 				DisconnectChan: make(chan struct{}, 1),
 			}
+			connection.SetRouteOptions(toKey, opts)
 
-			ConnectionMap[fromKey] = &connection
+			manager.Router.SetConnection(fromKey, &connection)
 
 			//go connection.TransData()
 			// 先不用发数据，等fromkey上线之后再发数据
-			go manager.WaitForFromKey(&connection, fromKey)
-			go connection.ReportConnectStatus()
+			manager.WaitForFromKey(&connection, fromKey)
+			go connection.ReportConnectStatus(manager.Config.ConnReportInterval.Duration)
 		} else { // 既没有找到fromkey, 也没有找到tokey
-			RouteTable[fromKey] = append(RouteTable[fromKey], toKey)
 			connection := Connection{
-				ReadClient:     Client{},
-				WriteClients:   []Client{},
+				WriteClients:   []*Client{},
 				DisconnectChan: make(chan struct{}, 1),
 			}
+			connection.SetRouteOptions(toKey, opts)
 
-			ConnectionMap[fromKey] = &connection
+			manager.Router.SetConnection(fromKey, &connection)
 
 			//go connection.TransData()
 			// 先不用发数据，等fromkey上线之后再发数据
-			go manager.WaitForFromKey(&connection, fromKey)
-			go manager.WaitForToKey(&connection, toKey)
-			go connection.ReportConnectStatus()
+			manager.WaitForFromKey(&connection, fromKey)
+			manager.WaitForToKey(&connection, fromKey, toKey)
+			go connection.ReportConnectStatus(manager.Config.ConnReportInterval.Duration)
 		}
 	}
-
 }
 
 // 断开连接，这个断开是把连接的管道断开，设备是没有下线的
-func (manager *ClientManager) Disconnect(fromKey, toKey string) {
+func (manager *ClientManager) Disconnect(fromKey, toKey string) error {
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	return manager.disconnect(fromKey, toKey)
+}
+
+// 调用时必须持有 routes
+func (manager *ClientManager) disconnect(fromKey, toKey string) error {
+	if !manager.dropRoute(fromKey, toKey) {
+		return commands.Errorf(commands.CodeRouteUnknown, "route %s -> %s does not exist", fromKey, toKey)
+	}
+	return nil
+}
+
+// 删除一条路由，路由不存在时返回false
+// 这是from设备的最后一条路由时，连接实例也一起删除
+// 双向路由的另一个方向也一起删除
+// 调用时必须持有 routes
+func (manager *ClientManager) dropRoute(fromKey, toKey string) bool {
+	partner, duplex := manager.Router.Partner(fromKey, toKey)
+	if !manager.Router.RemoveRoute(fromKey, toKey) {
+		return false
+	}
+	manager.detach(fromKey, toKey)
+	if duplex {
+		manager.detach(partner.From, partner.To)
+	}
+	return true
+}
+
+// 路由已经从路由表中删除，断开它的设备
+func (manager *ClientManager) detach(fromKey, toKey string) {
+	manager.Pending.Cancel(fromKey, toKey)
+
 	// 找到这个连接实例
-	// 往这个连接实例中的disConnectChan中发送信号
-	if conn, ok := ConnectionMap[fromKey]; ok {
-		conn.DeleteWriteClient(toKey)
+	conn, ok := manager.Router.Connection(fromKey)
+	if !ok {
+		return
 	}
+	conn.DeleteWriteClient(toKey)
+	conn.RemoveRouteOptions(toKey)
+	// 正在广播的连接实例等广播结束时再删除
+	if len(manager.Router.RoutesFrom(fromKey)) == 0 && !conn.Broadcasting() {
+		manager.Router.RemoveConnection(fromKey)
+		manager.Pending.CancelFrom(fromKey)
+		conn.Stop()
+	}
+}
+
+// reset、routes指令中每条路由的处理结果，作为ack指令的data回复给s10
+type RouteResult struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Action string `json:"action"` // 见 Route* 常量
+	Code   int    `json:"code"`   // 0表示成功，其余见 commands 包中的状态码
+	Msg    string `json:"msg,omitempty"`
 }
 
+// reset、routes指令对每条路由做了什么
+const (
+	RouteKept    = "kept"    // 在保留列表中，继续转发
+	RouteClosed  = "closed"  // 不在保留列表中，已经断开
+	RouteMissing = "missing" // 在保留列表中，但s12上没有这条路由
+	RouteAdded   = "added"   // routes指令使用，s12上原来没有，已经建立
+)
+
 // 重置连接，批量管理Connection
-// 解释data里的数据，存到一个数组中
-// 然后遍历这个数组
-// 如果ConnectionMap中的key在这个数组，则断开这个连接
-func (manager *ClientManager) Reset(data string) {
-	// version 1
-	connArray := strings.Split(data, ",")
-	for _, conn := range connArray {
-		keys := strings.Split(conn, "=")
-		fromKey := keys[0]
-		toKey := keys[1]
-		id := fromKey + toKey
-		for key, value := range ConnectionMap {
-			if key == id {
-				value.DisconnectChan <- struct{}{}
-			}
-		}
+// data的格式与routes指令相同："from=to,from=to"，列出的是要保留的路由，空字符串表示一条都不保留
+// 不在列表中的路由全部断开，包括在等设备上线的路由
+// data格式不对时不做任何修改；列出的路由不存在不算失败，在结果中标记为missing
+// 结果先按data中的顺序列出要保留的路由，再按from、to排序列出断开的路由
+func (manager *ClientManager) Reset(data string) ([]RouteResult, error) {
+	pairs, err := ParseRoutePairs(data)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (manager *ClientManager) Reset2(data string) {
-	// version 2
-	// 在这个数组中的连接将保留
-	connArray := strings.Split(data, ",")
-	var KeepConn []string
-	for _, conn := range connArray {
-		keys := strings.Split(conn, "=")
-		fromKey := keys[0]
-		toKey := keys[1]
-		id := fromKey + toKey
-		KeepConn = append(KeepConn, id)
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	results := []RouteResult{}
+	keep := make(map[RoutePair]bool, len(pairs))
+	for _, pair := range pairs {
+		if keep[pair] {
+			continue
+		}
+		keep[pair] = true
+		result := RouteResult{From: pair.From, To: pair.To, Action: RouteKept}
+		if !manager.Router.HasRoute(pair.From, pair.To) {
+			result.Action = RouteMissing
+			result.Code = commands.CodeRouteUnknown
+			result.Msg = fmt.Sprintf("route %s -> %s does not exist", pair.From, pair.To)
+		}
+		results = append(results, result)
 	}
-	for key, value := range ConnectionMap {
-		exist := false
-		for _, conn := range KeepConn {
-			if key == conn {
-				exist = true
-			}
+
+	// 双向路由算作一条，列出任何一个方向都会保留
+	var closing []RoutePair
+	for _, pair := range manager.Router.Pairs() {
+		if keep[pair] {
+			continue
+		}
+		if partner, ok := manager.Router.Partner(pair.From, pair.To); ok && keep[partner] {
+			continue
 		}
-		if !exist {
-			value.DisconnectChan <- struct{}{}
+		closing = append(closing, pair)
+	}
+
+	for _, pair := range closing {
+		result := RouteResult{From: pair.From, To: pair.To, Action: RouteClosed}
+		if err := manager.disconnect(pair.From, pair.To); err != nil {
+			// 断开的同时路由可能已经被删掉了
+			result.Code, result.Msg = commands.ErrorCode(err)
 		}
+		results = append(results, result)
 	}
+	return results, nil
 }
 
 // 关闭指定设备的连接
-func (manager *ClientManager) Close(data string) {
-	for client, _ := range manager.Clients {
-		if client.Key == data {
-			manager.Unregister <- client
-		}
+// 同一个key有多个会话时全部关闭
+func (manager *ClientManager) Close(data string) error {
+	sessions := manager.Clients.Sessions(data)
+	if len(sessions) == 0 {
+		return commands.Errorf(commands.CodeDeviceUnknown, "device %s is not online", data)
 	}
+	for _, client := range sessions {
+		manager.Unregister <- client
+	}
+	return nil
 }
 
 // 设备上下线发送的report指令
@@ -398,36 +737,50 @@ func (manager *ClientManager) Report(conn *Client, state string) {
 
 	connStatus := commands.ConnectStatus{}
 	connStatus.State = state
-	connStatus.Routers = RouteTable
-	connStatus.WhiteList = commands.PermissionKey
+	connStatus.Routers, connStatus.Duplex = manager.Router.Tables()
+	connStatus.Broadcasts = manager.BroadcastList()
+	connStatus.WhiteList = commands.AllowedKeys()
 
 	clients := make(map[string]interface{})
 	//for client, _ := range manager.Clients {
 	//	clients[client.Key] = *client
 	//	//util.SmartPrint(*client)
 	//}
-	clients[conn.Key] = conn
+	clients[conn.Key] = conn.Status()
 
 	connStatus.Clients = clients
 	// TODO: connStatus.Active
 
 	connStatusJSON, err := json.Marshal(connStatus)
 	if err != nil {
-		fmt.Println("Can't encode data: ", err)
+		logger.Error("can't encode report", logger.Err(err))
 		return
 	}
 
 	report.Data = string(connStatusJSON)
 
-	fmt.Println("report指令内容：", report)
+	logger.Debug("report", logger.CmdId(report.CmdId), logger.Payload(connStatusJSON))
 
-	commands.OutCmdChan <- report
+	commands.OutCmdQueue.Push(report)
 	return
 }
 
 // 设备上下线发送的report指令
 // 生成一条report指令放到写通道中
 func (manager *ClientManager) ReportAll() {
+	report, err := manager.SnapshotReport()
+	if err != nil {
+		logger.Error("can't encode report", logger.Err(err))
+		return
+	}
+
+	logger.Debug("report", logger.CmdId(report.CmdId), logger.Payload([]byte(report.Data)))
+
+	commands.OutCmdQueue.Push(report)
+}
+
+// 生成一条包含所有设备和路由的report指令
+func (manager *ClientManager) SnapshotReport() (commands.Cmd, error) {
 	report := commands.Cmd{
 		CmdId:   util.GetCmdId(),
 		Cmd:     "report",
@@ -442,13 +795,13 @@ func (manager *ClientManager) ReportAll() {
 	}
 
 	connStatus := commands.ConnectStatus{}
-	connStatus.Routers = RouteTable
-	connStatus.WhiteList = commands.PermissionKey
+	connStatus.Routers, connStatus.Duplex = manager.Router.Tables()
+	connStatus.Broadcasts = manager.BroadcastList()
+	connStatus.WhiteList = commands.AllowedKeys()
 
 	clients := make(map[string]interface{})
-	for client, _ := range manager.Clients {
-		clients[client.Key] = *client
-		//util.SmartPrint(*client)
+	for _, status := range manager.List(ClientFilter{}) {
+		clients[status.Key] = status
 	}
 
 	connStatus.Clients = clients
@@ -456,87 +809,53 @@ func (manager *ClientManager) ReportAll() {
 
 	connStatusJSON, err := json.Marshal(connStatus)
 	if err != nil {
-		fmt.Println("Can't encode data: ", err)
-		return
+		return report, err
 	}
 
 	report.Data = string(connStatusJSON)
-
-	fmt.Println("report指令内容：", report)
-
-	commands.OutCmdChan <- report
-	return
+	return report, nil
 }
 
+// 通知除了ignore之外的所有设备，与notify指令一样不会阻塞
 func (manager *ClientManager) send(message []byte, ignore *Client) {
-	for conn := range manager.Clients {
+	for _, conn := range manager.Clients.All() {
 		if conn != ignore {
-			conn.Write <- message
+			conn.offer(Frame{Type: websocket.TextMessage, Data: message})
 		}
 	}
 }
 
-// S12收到broadcast指令后，首先更新BroadcastTable
-// 广播结束的标志是什么
-func (manager *ClientManager) HandleBroadcast(fromKey, toKey string) {
-
-	toKeyArray := strings.Split(toKey, ",")
-
-	if conn, ok := ConnectionMap[fromKey]; ok {
-		// 说明已经在发送数据了，现转为广播
-		// 广播结束的时候要把标志改为false
-		conn.IsBroadcasting = true
-
-		for _, key := range toKeyArray {
-			if client, ok := manager.CheckClientExist(key); ok {
-				client.BroadcastRecv = true
-				conn.BroadcastClients = append(conn.BroadcastClients, *client)
-			} else {
-				// 应该扩充tokey，是加入writeClient还是broadcastClient
-				go manager.WaitForToKey(conn, key)
-			}
-		}
-
-	} else {
-		// 新建一个Connection
-		connection := Connection{
-			IsBroadcasting: true,
-			WriteClients: []Client{},
-		}
-
-		if conn, ok := manager.CheckClientExist(fromKey); ok {
-			connection.ReadClient = *conn
+// 向所有设备或者某一类设备发送一条通知，deviceType为空表示所有设备
+// 通知放到设备的写队列中，队列满了就丢掉这条通知，不会阻塞也不会断开跟不上的设备
+// 返回送进队列和丢掉的设备数
+func (manager *ClientManager) Notify(deviceType string, frame Frame) (delivered, dropped int) {
+	clients := manager.Clients.All()
+	if deviceType != "" {
+		clients = manager.Clients.ByType(deviceType)
+	}
+	for _, client := range clients {
+		if client.offer(frame) {
+			delivered++
 		} else {
-			go manager.WaitForFromKey(&connection, fromKey)
-		}
-
-		for _, toKey := range toKeyArray {
-			if conn, ok := manager.CheckClientExist(toKey); ok {
-				connection.BroadcastClients = append(connection.BroadcastClients, *conn)
-			} else {
-				go manager.WaitForFromKey(&connection, toKey)
-			}
+			dropped++
 		}
-
-		ConnectionMap[fromKey] = &connection
 	}
-
-	BroadcastTable[fromKey] = toKeyArray
+	return delivered, dropped
 }
 
 func (manager *ClientManager) ReportCurrentState() {
-	ticker := time.NewTicker(20 * time.Second)
+	ticker := time.NewTicker(manager.Config.StateReportInterval.Duration)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			fmt.Println("my key: ", commands.S12Key)
-			fmt.Println("当前连接数：", len(ConnectionMap))
-			fmt.Printf("当前有%d个设备在连接\n", len(manager.Clients))
-			fmt.Println("允许连接的key:")
-			for _, key := range commands.PermissionKey {
-				fmt.Println("key: ", key)
-			}
+			logger.Info("state",
+				logger.Secret("s12key", commands.GetS12Key()),
+				logger.F("connections", manager.Router.ConnectionCount()),
+				logger.F("devices", manager.Clients.Len()),
+				logger.F("devicetypes", manager.CountByType()),
+				logger.F("pending", manager.Pending.Len()),
+				logger.F("permitted", len(commands.AllowedKeys())))
 		}
 	}
 }
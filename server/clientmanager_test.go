@@ -0,0 +1,146 @@
+package server
+
+import (
+	"reflect"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// 路由表中有路由的设备，和有连接实例的设备
+func routeOwners(manager *ClientManager) (routes, conns []string) {
+	routes, conns = []string{}, []string{}
+	for from := range manager.Router.Snapshot() {
+		routes = append(routes, from)
+	}
+	for from, conn := range manager.Router.Connections() {
+		select {
+		case <-conn.DisconnectChan:
+			// 已经停止的连接实例不会再转发
+		default:
+			conns = append(conns, from)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(conns)
+	return routes, conns
+}
+
+// s10反复建立、断开路由的同时设备反复上下线
+// 每条路由都要有还在工作的连接实例，不能留下一条永远不转发的路由
+func TestRoutesWhileDevicesComeAndGo(t *testing.T) {
+	manager := NewClientManager(config.Default())
+	receiver := newBenchClient("d")
+	manager.Clients.Add(receiver)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			manager.Connect("a", "d", RouteOptions{})
+			if i%3 == 0 {
+				manager.Disconnect("a", "d")
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			sender := newBenchClient("a")
+			manager.Clients.Add(sender)
+			manager.routes.Lock()
+			manager.Pending.Notify(sender)
+			manager.routes.Unlock()
+
+			manager.Clients.Remove(sender)
+			manager.releaseRoutes(sender)
+		}
+	}()
+	wg.Wait()
+
+	routes, conns := routeOwners(manager)
+	if !reflect.DeepEqual(routes, conns) {
+		t.Fatalf("devices with routes = %v, devices with a running connection = %v", routes, conns)
+	}
+	if len(routes) == 0 {
+		return
+	}
+	conn, _ := manager.Router.Connection("a")
+	if conn.readClient() != nil {
+		t.Fatal("route a -> d still reads from a device that went offline")
+	}
+}
+
+// 设备下线时按conn指令的persist保留或删除路由，发送方和接收方下线都一样
+func TestOfflineKeepsPersistRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		persist bool
+		offline string
+		routes  map[string][]string
+	}{
+		{"sender, persist", true, "a", map[string][]string{"a": {"d"}}},
+		{"receiver, persist", true, "d", map[string][]string{"a": {"d"}}},
+		{"sender", false, "a", map[string][]string{}},
+		{"receiver", false, "d", map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewClientManager(config.Default())
+			clients := map[string]*Client{"a": newBenchClient("a"), "d": newBenchClient("d")}
+			for _, client := range clients {
+				manager.Clients.Add(client)
+			}
+			if err := manager.Connect("a", "d", RouteOptions{Persist: tt.persist}); err != nil {
+				t.Fatalf("Connect(a, d): %v", err)
+			}
+
+			gone := clients[tt.offline]
+			manager.Clients.Remove(gone)
+			if !manager.releaseRoutes(gone) {
+				t.Fatalf("releaseRoutes(%s) = false, want the key reported offline", tt.offline)
+			}
+			if routes := manager.Router.Snapshot(); !reflect.DeepEqual(routes, tt.routes) {
+				t.Fatalf("routes after %s went offline = %v, want %v", tt.offline, routes, tt.routes)
+			}
+			if len(tt.routes) == 0 {
+				return
+			}
+
+			// 设备重新上线后路由自动接上
+			back := newBenchClient(tt.offline)
+			manager.Clients.Add(back)
+			manager.routes.Lock()
+			manager.Pending.Notify(back)
+			manager.routes.Unlock()
+			clients[tt.offline] = back
+			conn, _ := manager.Router.Connection("a")
+			_, writeClients, _, _, _ := conn.receivers()
+			if conn.readClient() != clients["a"] || !reflect.DeepEqual(writeClients, []*Client{clients["d"]}) {
+				t.Fatalf("route a -> d is not attached to the new session of %s", tt.offline)
+			}
+		})
+	}
+}
+
+// 不认识的指令都记在cmd="unknown"下
+func TestCommandMetricsUnknownCmd(t *testing.T) {
+	manager := NewClientManager(config.Default())
+	for _, name := range []string{"foo", "bar", "disconn"} {
+		cmd := commands.Cmd{Cmd: name}
+		_, err := manager.ExecCommand(cmd)
+		manager.metrics.command(cmd.Cmd, err)
+	}
+	if n := manager.metrics.commands.Value("unknown", "error"); n != 2 {
+		t.Fatalf(`cmd="unknown" counted %d, want 2`, n)
+	}
+	if n := manager.metrics.commands.Value("foo", "error"); n != 0 {
+		t.Fatalf(`cmd="foo" counted %d, want 0`, n)
+	}
+	if n := manager.metrics.commands.Value("disconn", "error"); n != 1 {
+		t.Fatalf(`cmd="disconn" counted %d, want 1`, n)
+	}
+}
@@ -1,107 +1,304 @@
 package server
 
 import (
-	"fmt"
+	"sanji_s12/logger"
+	"sync"
 	"time"
 )
 
-// 保存连接的map
-// key就是fromKey
-// map中如果要修改Struct中的值，需要用指针的方式
-var ConnectionMap = make(map[string]*Connection)
-
-// 路由表，键是需要读取数据的设备，值是需要接收数据的设备
-// 因为s10发送指令的时候，accept, conn指令是同时发送的
-// 所以有可能在s10还没收到accept指令的时候，就收到了conn指令
-// 当s12收到accept指令的时候，就往这个路由中加入一条记录
-// 如果收发数据的设备都在线的话，就开始转发数据
-var RouteTable = make(map[string][]string)
-
-var BroadcastTable = make(map[string][]string)
-
 // 连接实例
 type Connection struct {
 	// 对于每一个连接，是否需要一个id
-	ReadClient       Client   // from
-	WriteClients     []Client // to
+	// 保存的都是在线设备的指针，设备下线后CloseChan关闭，转发时可以知道它已经不在了
+	ReadClient       *Client   // from，设备还没上线时为nil
+	WriteClients     []*Client // to
 	IsBroadcasting   bool
-	BroadcastClients []Client // broadcast
+	BroadcastClients []*Client                 // broadcast
+	Options          map[string]RouteOptions   // 每条路由的设置，键是toKey
+	Counters         map[string]*RouteCounters // 每条路由转发的数据量，键是toKey，和Options一起增删
 
 	DisconnectChan chan struct{} //
+
+	// 保护上面的字段，收到指令和设备上线的时候会修改它们，转发数据的协程同时在读
+	lock sync.RWMutex
+	stop sync.Once
 }
 
 // 两个设备发送数据
 // 从fromkey中读出数据，发送到tokey中
+// 阻塞等待数据或断开信号，没有数据的时候不占用CPU
 func (c *Connection) TransData() {
-	fmt.Println("start trans data...")
+	from := c.readClient()
+	if from == nil {
+		return
+	}
+	logger.Debug("start forwarding", logger.Key(from.Key))
+	from.startForwarding()
+	defer from.stopForwarding()
 	for {
 		select {
 		case <-c.DisconnectChan:
 			//断开两个连接
-			fmt.Println("断开这个连接")
-			// 从map中删除这个元素
-			//delete(ConnectionMap, c.ID)
+			logger.Debug("stop forwarding", logger.Key(from.Key))
 			return
-		case data := <-c.ReadClient.Read:
-			fmt.Println("data read: ", data)
-			if c.IsBroadcasting {
-				// 如果正在广播，就只发送给接收广播的设备就好了
-				for _, bClient := range c.BroadcastClients {
-					bClient.Write <- data
-				}
-				break
+		case <-from.CloseChan:
+			// 发送数据的设备已经下线
+			return
+		case frame := <-from.Read:
+			if logger.Enabled(logger.DebugLevel) {
+				logger.Debug("data read", logger.Key(from.Key), logger.F("msgtype", frame.Type), logger.Payload(frame.Data))
 			}
+			c.forward(from.Key, frame)
+		}
+	}
+}
 
-			for _, wClient := range c.WriteClients {
-				if wClient.BroadcastRecv {
-					// 如果这个设备正在接收广播，就不发给它了
-					break
-				}
-				fmt.Println("writing data to ", wClient.Key)
-				wClient.Write <- data
+// 把from发来的一帧数据发给当前所有接收数据的设备
+func (c *Connection) forward(from string, frame Frame) {
+	isBroadcasting, writeClients, broadcastClients, options, counters := c.receivers()
+	if isBroadcasting {
+		// 如果正在广播，就只发送给接收广播的设备就好了
+		for _, bClient := range broadcastClients {
+			bClient.Send(frame)
+		}
+		return
+	}
+
+	for _, wClient := range writeClients {
+		if wClient.BroadcastRecv() || !wClient.Online() {
+			// 如果这个设备正在接收广播或者已经下线，就不发给它了
+			continue
+		}
+		opts := options[wClient.Key]
+		out := frame
+		if opts.MsgType != 0 {
+			out.Type = opts.MsgType
+		}
+		if opts.Envelope {
+			out = envelope(from, out)
+		}
+		if wClient.Send(out) {
+			// 这条路由可能刚刚被删掉，计数也一起删掉了
+			if counter, ok := counters[wClient.Key]; ok {
+				counter.add(len(out.Data))
 			}
+		}
+	}
+}
+
+// 停止这个连接的所有协程
+// 关闭DisconnectChan，所有在等它的协程都会收到信号
+func (c *Connection) Stop() {
+	c.stop.Do(func() {
+		if c.DisconnectChan != nil {
+			close(c.DisconnectChan)
+		}
+	})
+}
+
+// 发送数据的设备
+func (c *Connection) readClient() *Client {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.ReadClient
+}
 
-		default:
+// 当前要接收数据的设备
+// 修改设备列表时只追加或者重新分配切片，修改路由设置时整个替换map，
+// 不会改动已经返回出去的内容，所以转发数据的时候不需要拷贝，也不需要持有锁
+func (c *Connection) receivers() (bool, []*Client, []*Client, map[string]RouteOptions, map[string]*RouteCounters) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.IsBroadcasting, c.WriteClients, c.BroadcastClients, c.Options, c.Counters
+}
+
+// 设置到toKey这条路由的选项
+func (c *Connection) SetRouteOptions(toKey string, opts RouteOptions) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	options := make(map[string]RouteOptions, len(c.Options)+1)
+	for key, value := range c.Options {
+		options[key] = value
+	}
+	options[toKey] = opts
+	c.Options = options
 
+	// 修改已有路由的设置时保留原来的计数
+	if _, ok := c.Counters[toKey]; !ok {
+		counters := make(map[string]*RouteCounters, len(c.Counters)+1)
+		for key, value := range c.Counters {
+			counters[key] = value
 		}
+		counters[toKey] = &RouteCounters{}
+		c.Counters = counters
 	}
+}
+
+// 到toKey这条路由的选项
+func (c *Connection) OptionsFor(toKey string) RouteOptions {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
+	return c.Options[toKey]
+}
+
+// 删除到toKey这条路由的选项
+func (c *Connection) RemoveRouteOptions(toKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.Options[toKey]; !ok {
+		return
+	}
+	options := make(map[string]RouteOptions, len(c.Options))
+	for key, value := range c.Options {
+		if key != toKey {
+			options[key] = value
+		}
+	}
+	c.Options = options
+
+	counters := make(map[string]*RouteCounters, len(c.Counters))
+	for key, value := range c.Counters {
+		if key != toKey {
+			counters[key] = value
+		}
+	}
+	c.Counters = counters
+}
+
+// 每条路由转发的数据量，键是toKey
+func (c *Connection) RouteCounters() map[string]*RouteCounters {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Counters
+}
+
+// 发送数据的设备上线，下线时设为nil
+func (c *Connection) SetReadClient(client *Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ReadClient = client
+}
+
+// 发送数据的设备的key，设备还没上线时为空
+func (c *Connection) ReadKey() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.ReadClient == nil {
+		return ""
+	}
+	return c.ReadClient.Key
 }
 
 // 新加入一个接入数据的设备，实现一对多传输
-func (c *Connection) AddWriteClient(client Client) {
+// 同一个key已经在里面时换成新的会话
+func (c *Connection) AddWriteClient(client *Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for index, value := range c.WriteClients {
+		if value.Key == client.Key {
+			clients := append([]*Client(nil), c.WriteClients...)
+			clients[index] = client
+			c.WriteClients = clients
+			return
+		}
+	}
 	c.WriteClients = append(c.WriteClients, client)
 }
 
+// 接收数据的设备换了一个会话，把old换成current
+func (c *Connection) ReplaceWriteClient(old, current *Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for index, value := range c.WriteClients {
+		if value == old {
+			clients := append([]*Client(nil), c.WriteClients...)
+			clients[index] = current
+			c.WriteClients = clients
+			return
+		}
+	}
+}
+
 // s10主动要求断开某个连接
 func (c *Connection) DeleteWriteClient(toKey string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	for index, value := range c.WriteClients {
 		if value.Key == toKey {
-			c.WriteClients = append(c.WriteClients[:index], c.WriteClients[index+1:]...)
-			// TODO：修改路由表
-			fmt.Println(ConnectionMap)
+			c.WriteClients = append(c.WriteClients[:index:index], c.WriteClients[index+1:]...)
 			break
 		}
 	}
 }
 
-func (c *Connection) StopBroadcasting() {
+// 开始广播，后续的数据只发给接收广播的设备
+func (c *Connection) StartBroadcasting(clients []*Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.IsBroadcasting = true
+	c.BroadcastClients = append([]*Client(nil), clients...)
+}
+
+// 接收广播的设备上线，同一个key已经在里面时换成新的会话
+func (c *Connection) AddBroadcastClient(client *Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	clients := make([]*Client, 0, len(c.BroadcastClients)+1)
+	for _, value := range c.BroadcastClients {
+		if value.Key != client.Key {
+			clients = append(clients, value)
+		}
+	}
+	c.BroadcastClients = append(clients, client)
+}
+
+// 结束广播，恢复原来的路由，返回接收广播的设备
+func (c *Connection) StopBroadcasting() []*Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	clients := c.BroadcastClients
 	c.IsBroadcasting = false
+	c.BroadcastClients = nil
+	return clients
+}
+
+// 是否正在广播
+func (c *Connection) Broadcasting() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.IsBroadcasting
 }
 
 // 打印当前连接实例的信息
-func (c *Connection) ReportConnectStatus() {
-	ticker := time.NewTicker(10 * time.Second)
+func (c *Connection) ReportConnectStatus(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if c.ReadClient.Key != "" {
-				fmt.Println("readClient已经在线：", c.ReadClient.Key)
+			if !logger.Enabled(logger.DebugLevel) {
+				continue
 			}
-			fmt.Printf("我要向%d个Client发送数据。\n", len(c.WriteClients))
-			for _, client := range c.WriteClients {
-				fmt.Println(client.Key + " is recieving message.")
+			// 发送数据的设备不在线时ReadKey为空
+			from := c.ReadKey()
+			_, writeClients, _, _, _ := c.receivers()
+			for _, client := range writeClients {
+				logger.Debug("connection status", logger.Route(from, client.Key), logger.F("online", from != ""))
 			}
 		case <-c.DisconnectChan:
 			return
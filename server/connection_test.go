@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"sanji_s12/config"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// 不带socket的设备，写队列里的数据由drain取走
+func newBenchClient(key string) *Client {
+	return &Client{
+		Key:         key,
+		Read:        make(chan Frame, 64),
+		Write:       make(chan Frame, 64),
+		CloseChan:   make(chan struct{}),
+		WritePolicy: config.WritePolicyBlock,
+		counters:    &clientCounters{},
+	}
+}
+
+// 取走设备写队列中的数据，每取走一帧调用一次wg.Done
+func drain(client *Client, wg *sync.WaitGroup, stop chan struct{}) {
+	for {
+		select {
+		case <-client.Write:
+			wg.Done()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// 建立n条 from-i -> to-i 的路由
+func startRoutes(n int, wg *sync.WaitGroup, stop chan struct{}) []*Connection {
+	conns := make([]*Connection, n)
+	for i := 0; i < n; i++ {
+		from := newBenchClient(fmt.Sprintf("from-%d", i))
+		to := newBenchClient(fmt.Sprintf("to-%d", i))
+		conns[i] = &Connection{
+			ReadClient:     from,
+			WriteClients:   []*Client{to},
+			DisconnectChan: make(chan struct{}, 1),
+		}
+		go conns[i].TransData()
+		go drain(to, wg, stop)
+	}
+	return conns
+}
+
+// 同时有1、10、1000条路由在转发数据时的吞吐量
+func BenchmarkTransData(b *testing.B) {
+	payload := Frame{Type: websocket.BinaryMessage, Data: make([]byte, 1024)}
+	for _, n := range []int{1, 10, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", n), func(b *testing.B) {
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			conns := startRoutes(n, &wg, stop)
+
+			b.SetBytes(int64(len(payload.Data)))
+			b.ResetTimer()
+			wg.Add(b.N)
+			for i := 0; i < b.N; i++ {
+				conns[i%n].ReadClient.Read <- payload
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			for _, conn := range conns {
+				conn.Stop()
+			}
+			close(stop)
+		})
+	}
+}
+
+// 一个发送方对应多个接收方时的吞吐量
+func BenchmarkTransDataFanOut(b *testing.B) {
+	payload := Frame{Type: websocket.BinaryMessage, Data: make([]byte, 1024)}
+	for _, n := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("receivers=%d", n), func(b *testing.B) {
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			from := newBenchClient("from")
+			conn := &Connection{
+				ReadClient:     from,
+				DisconnectChan: make(chan struct{}, 1),
+			}
+			for i := 0; i < n; i++ {
+				to := newBenchClient(fmt.Sprintf("to-%d", i))
+				conn.AddWriteClient(to)
+				go drain(to, &wg, stop)
+			}
+			go conn.TransData()
+
+			b.SetBytes(int64(len(payload.Data)))
+			b.ResetTimer()
+			wg.Add(b.N * n)
+			for i := 0; i < b.N; i++ {
+				from.Read <- payload
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			conn.Stop()
+			close(stop)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 进程到目前为止用掉的CPU时间
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// 路由建立后没有数据时的CPU占用，单位是每秒占用的CPU毫秒数
+// 转发协程阻塞在管道上，结果应该接近0，而不是每条路由占满一个核
+func BenchmarkIdleRoutes(b *testing.B) {
+	for _, n := range []int{1, 10, 1000} {
+		b.Run(fmt.Sprintf("routes=%d", n), func(b *testing.B) {
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			conns := startRoutes(n, &wg, stop)
+
+			window := 100 * time.Millisecond
+			b.ResetTimer()
+			before := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				time.Sleep(window)
+			}
+			used := cpuTime(b) - before
+			b.StopTimer()
+
+			elapsed := time.Duration(b.N) * window
+			b.ReportMetric(float64(used)/float64(time.Millisecond)/elapsed.Seconds(), "cpu-ms/s")
+
+			for _, conn := range conns {
+				conn.Stop()
+			}
+			close(stop)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sanji_s12/commands"
+
+	"github.com/gorilla/websocket"
+)
+
+// 转发的一帧数据，带上设备发过来时的消息类型，原样转给接收方
+type Frame struct {
+	Type int // websocket.TextMessage 或 websocket.BinaryMessage
+	Data []byte
+}
+
+// 每条路由的设置，由conn指令带过来
+type RouteOptions struct {
+	MsgType  int  // 不为0时，强制以这个消息类型发给接收方
+	Persist  bool // 设备下线后路由进入等待状态而不是删除
+	Envelope bool // 转发时带上发送方的key，见 envelope
+	Duplex   bool // 双向路由，两个方向使用同一份设置
+}
+
+// 给数据帧加上发送方的key，接收方同时接收多个设备的数据时据此区分来源
+// 文本帧：{"from":"<key>","data":"<原来的文本>"}
+// 二进制帧：2字节大端序的key长度 + key + 原来的数据
+func envelope(from string, frame Frame) Frame {
+	if frame.Type == websocket.TextMessage {
+		data, _ := json.Marshal(struct {
+			From string `json:"from"`
+			Data string `json:"data"`
+		}{from, string(frame.Data)})
+		return Frame{Type: frame.Type, Data: data}
+	}
+
+	data := make([]byte, 2+len(from)+len(frame.Data))
+	binary.BigEndian.PutUint16(data, uint16(len(from)))
+	copy(data[2:], from)
+	copy(data[2+len(from):], frame.Data)
+	return Frame{Type: frame.Type, Data: data}
+}
+
+// 解析conn指令中的msgtype字段
+// 空字符串表示保持原来的消息类型
+func ParseMsgType(value string) (int, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "text":
+		return websocket.TextMessage, nil
+	case "binary":
+		return websocket.BinaryMessage, nil
+	}
+	return 0, commands.Errorf(commands.CodeBadData, "unknown msgtype %q", value)
+}
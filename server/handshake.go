@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sanji_s12/commands"
+	"sanji_s12/logger"
+	"sanji_s12/util"
+	"strings"
+)
+
+// 一条路由，from的数据发给to
+type RoutePair struct {
+	From string
+	To   string
+}
+
+// 解析 "from=to,from=to" 格式的路由列表，空字符串表示没有路由
+func ParseRoutePairs(data string) ([]RoutePair, error) {
+	var pairs []RoutePair
+	if strings.TrimSpace(data) == "" {
+		return pairs, nil
+	}
+	for _, item := range strings.Split(data, ",") {
+		keys := strings.Split(strings.TrimSpace(item), "=")
+		if len(keys) != 2 || keys[0] == "" || keys[1] == "" {
+			return nil, commands.Errorf(commands.CodeBadData, "malformed route %q", item)
+		}
+		pairs = append(pairs, RoutePair{From: keys[0], To: keys[1]})
+	}
+	return pairs, nil
+}
+
+// 与s10连上（包括重连）之后，在hello指令之后发给s10的指令
+// 1 当前所有设备和路由的report
+// 2 如果开启了SyncRoutes，向s10要一份权威的路由表，s10以routes指令回复
+func (manager *ClientManager) HandshakeCommands() []commands.Cmd {
+	var cmds []commands.Cmd
+
+	report, err := manager.SnapshotReport()
+	if err != nil {
+		logger.Error("can't encode report", logger.Err(err))
+	} else {
+		cmds = append(cmds, report)
+	}
+
+	if manager.Config.SyncRoutes {
+		cmds = append(cmds, commands.Cmd{
+			CmdId: util.GetCmdId(),
+			Cmd:   "routes",
+			Role:  "client",
+		})
+	}
+	return cmds
+}
+
+// 按s10下发的路由表对齐本地路由：
+// 本地有而s10没有的路由断开，s10有而本地没有的路由建立
+// 本地的双向路由算作一条，s10列出任何一个方向都保留
+// data格式不对时不做任何修改；否则每条路由都处理一遍，某一条失败不影响其余的，
+// 结果与reset指令相同，先按data中的顺序列出要保留或者建立的路由，再列出断开的路由
+func (manager *ClientManager) SyncRoutes(data string) ([]RouteResult, error) {
+	pairs, err := ParseRoutePairs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.routes.Lock()
+	defer manager.routes.Unlock()
+
+	wanted := make(map[RoutePair]bool, len(pairs))
+	for _, pair := range pairs {
+		wanted[pair] = true
+	}
+
+	var closed []RouteResult
+	for _, pair := range manager.Router.Pairs() {
+		if wanted[pair] {
+			continue
+		}
+		if partner, ok := manager.Router.Partner(pair.From, pair.To); ok && wanted[partner] {
+			continue
+		}
+		logger.Info("route removed by s10", logger.Route(pair.From, pair.To))
+		result := RouteResult{From: pair.From, To: pair.To, Action: RouteClosed}
+		if err := manager.disconnect(pair.From, pair.To); err != nil {
+			result.Code, result.Msg = commands.ErrorCode(err)
+		}
+		closed = append(closed, result)
+	}
+
+	results := []RouteResult{}
+	for _, pair := range pairs {
+		if !wanted[pair] {
+			continue
+		}
+		delete(wanted, pair)
+		result := RouteResult{From: pair.From, To: pair.To, Action: RouteKept}
+		// 本地已经有的路由，包括本地双向路由的另一个方向
+		if !manager.Router.HasRoute(pair.From, pair.To) {
+			logger.Info("route added by s10", logger.Route(pair.From, pair.To))
+			result.Action = RouteAdded
+			if err := manager.connect(pair.From, pair.To, RouteOptions{}); err != nil {
+				result.Code, result.Msg = commands.ErrorCode(err)
+			}
+		}
+		results = append(results, result)
+	}
+	return append(results, closed...), nil
+}
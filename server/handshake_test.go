@@ -0,0 +1,101 @@
+package server
+
+import (
+	"reflect"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"testing"
+)
+
+func TestSyncRoutes(t *testing.T) {
+	result := func(action, from, to string) RouteResult {
+		return RouteResult{From: from, To: to, Action: action}
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []RouteResult
+		routes  map[string][]string
+		errCode int
+	}{
+		{
+			name: "add and remove",
+			data: "a=b,d=f",
+			want: []RouteResult{
+				result(RouteKept, "a", "b"), result(RouteAdded, "d", "f"),
+				result(RouteClosed, "a", "c"), result(RouteClosed, "d", "e"), result(RouteClosed, "x", "y"),
+			},
+			routes: map[string][]string{"a": {"b"}, "d": {"f"}},
+		},
+		{
+			name: "duplex listed in both directions",
+			data: "x=y,y=x,a=b",
+			want: []RouteResult{
+				result(RouteKept, "x", "y"), result(RouteKept, "y", "x"), result(RouteKept, "a", "b"),
+				result(RouteClosed, "a", "c"), result(RouteClosed, "d", "e"),
+			},
+			routes: map[string][]string{"a": {"b"}, "x": {"y"}, "y": {"x"}},
+		},
+		{
+			name: "duplex listed in one direction",
+			data: "y=x,a=b,a=c,d=e",
+			want: []RouteResult{
+				result(RouteKept, "y", "x"), result(RouteKept, "a", "b"), result(RouteKept, "a", "c"), result(RouteKept, "d", "e"),
+			},
+			routes: map[string][]string{"a": {"b", "c"}, "d": {"e"}, "x": {"y"}, "y": {"x"}},
+		},
+		{
+			name:   "duplicate pair",
+			data:   "f=g,f=g",
+			want:   []RouteResult{result(RouteAdded, "f", "g"), result(RouteClosed, "a", "b"), result(RouteClosed, "a", "c"), result(RouteClosed, "d", "e"), result(RouteClosed, "x", "y")},
+			routes: map[string][]string{"f": {"g"}},
+		},
+		{
+			name:   "nothing wanted",
+			data:   "",
+			want:   []RouteResult{result(RouteClosed, "a", "b"), result(RouteClosed, "a", "c"), result(RouteClosed, "d", "e"), result(RouteClosed, "x", "y")},
+			routes: map[string][]string{},
+		},
+		{
+			name:    "malformed",
+			data:    "a=b,f",
+			routes:  map[string][]string{"a": {"b", "c"}, "d": {"e"}, "x": {"y"}, "y": {"x"}},
+			errCode: commands.CodeBadData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newResetManager(t)
+			if err := manager.Connect("x", "y", RouteOptions{Duplex: true}); err != nil {
+				t.Fatalf("Connect(x, y, duplex): %v", err)
+			}
+
+			results, err := manager.SyncRoutes(tt.data)
+			if code, _ := commands.ErrorCode(err); code != tt.errCode {
+				t.Fatalf("SyncRoutes(%q) error = %v, want code %d", tt.data, err, tt.errCode)
+			}
+			if err == nil && !reflect.DeepEqual(results, tt.want) {
+				t.Errorf("SyncRoutes(%q) = %+v, want %+v", tt.data, results, tt.want)
+			}
+			if routes := manager.Router.Snapshot(); !reflect.DeepEqual(routes, tt.routes) {
+				t.Errorf("routes after SyncRoutes(%q) = %v, want %v", tt.data, routes, tt.routes)
+			}
+		})
+	}
+}
+
+// 同一份路由表再对齐一次，什么都不改
+func TestSyncRoutesTwice(t *testing.T) {
+	manager := NewClientManager(config.Default())
+	for i := 0; i < 2; i++ {
+		if _, err := manager.SyncRoutes("a=b,b=a"); err != nil {
+			t.Fatalf("SyncRoutes #%d: %v", i+1, err)
+		}
+	}
+	want := map[string][]string{"a": {"b"}, "b": {"a"}}
+	if routes := manager.Router.Snapshot(); !reflect.DeepEqual(routes, want) {
+		t.Fatalf("routes = %v, want %v", routes, want)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sanji_s12/commands"
+	"sanji_s12/metrics"
+	"sort"
+	"sync/atomic"
+)
+
+// 一条路由转发的数据量，只统计成功放进接收方写队列的数据
+type RouteCounters struct {
+	messages int64
+	bytes    int64
+}
+
+func (r *RouteCounters) add(n int) {
+	atomic.AddInt64(&r.messages, 1)
+	atomic.AddInt64(&r.bytes, int64(n))
+}
+
+func (r *RouteCounters) Messages() int64 { return atomic.LoadInt64(&r.messages) }
+func (r *RouteCounters) Bytes() int64    { return atomic.LoadInt64(&r.bytes) }
+
+// 累计的计数，设备和路由的当前状态在抓取时直接读
+type serverMetrics struct {
+	commands   *metrics.CounterVec // 执行的s10指令，按指令名和结果，不认识的指令都记为unknown
+	rejections *metrics.CounterVec // 被拒绝的设备连接，按原因
+	admin      *metrics.CounterVec // 令牌不对被拒绝的管理接口请求
+	dropped    *metrics.CounterVec // 写队列满了丢掉的数据帧，按设备类型
+	unrouted   *metrics.CounterVec // 设备发来但没有路由转发的数据帧，按设备类型
+	stalled    *metrics.CounterVec // 设备发来、有路由但转发跟不上而丢掉的数据帧，按设备类型
+}
+
+// 设备连接被拒绝的原因
+const (
+	RejectPermission   = "permission"    // key不在允许连接的列表中
+	RejectDuplicateKey = "duplicate_key" // 同一个key已经在线
+)
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		commands:   metrics.NewCounterVec("s12_commands_total", "Commands from s10 by name and result.", "cmd", "result"),
+		rejections: metrics.NewCounterVec("s12_auth_rejections_total", "Device connections rejected by s12.", "reason"),
+		admin:      metrics.NewCounterVec("s12_admin_rejections_total", "Admin requests rejected because of a missing or wrong token."),
+		dropped:    metrics.NewCounterVec("s12_dropped_frames_total", "Frames dropped because a device write queue was full.", "devicetype"),
+		unrouted:   metrics.NewCounterVec("s12_unrouted_frames_total", "Frames from devices dropped because no route forwarded them.", "devicetype"),
+		stalled:    metrics.NewCounterVec("s12_stalled_frames_total", "Frames from devices dropped because their route was still busy after write_wait.", "devicetype"),
+	}
+}
+
+// 记录一条指令的执行结果
+// 指令名来自s10，不认识的指令不单独计数，否则label的取值没有上限
+func (m *serverMetrics) command(cmd string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	if code, _ := commands.ErrorCode(err); code == commands.CodeUnknownCmd {
+		cmd = "unknown"
+	}
+	m.commands.Inc(cmd, result)
+}
+
+// 输出设备、路由和广播的当前状态以及累计的计数
+func (manager *ClientManager) Collect(w *metrics.Writer) {
+	counts := manager.CountByType()
+	deviceTypes := make([]string, 0, len(counts))
+	for deviceType := range counts {
+		deviceTypes = append(deviceTypes, deviceType)
+	}
+	sort.Strings(deviceTypes)
+	w.Family("s12_devices", "Devices online by device type.", metrics.TypeGauge)
+	for _, deviceType := range deviceTypes {
+		w.Sample("s12_devices", float64(counts[deviceType]), "devicetype", deviceType)
+	}
+
+	w.Single("s12_routes", "Active routes, a duplex route counts once.", metrics.TypeGauge, float64(len(manager.Router.Pairs())))
+	w.Single("s12_pending_routes", "Routes waiting for a device to come online.", metrics.TypeGauge, float64(manager.Pending.Len()))
+	w.Single("s12_broadcasts", "Broadcasts in progress.", metrics.TypeGauge, float64(len(manager.BroadcastList())))
+
+	manager.collectRoutes(w)
+
+	manager.metrics.dropped.Collect(w)
+	manager.metrics.unrouted.Collect(w)
+	manager.metrics.stalled.Collect(w)
+	manager.metrics.commands.Collect(w)
+	manager.metrics.rejections.Collect(w)
+	manager.metrics.admin.Collect(w)
+
+	w.Single("s12_upstream_queue_length", "Commands waiting to be sent to s10.", metrics.TypeGauge, float64(commands.OutCmdQueue.Len()))
+	w.Single("s12_upstream_queue_dropped_total", "Commands dropped because the s10 queue was full.", metrics.TypeCounter, float64(commands.OutCmdQueue.Dropped()))
+}
+
+// 每条路由转发的数据量，按from、to排序
+// 路由删除后它的计数也随之消失
+func (manager *ClientManager) collectRoutes(w *metrics.Writer) {
+	type sample struct {
+		from, to string
+		counters *RouteCounters
+	}
+	var samples []sample
+	for from, conn := range manager.Router.Connections() {
+		for to, counters := range conn.RouteCounters() {
+			samples = append(samples, sample{manager.metricsKey(from), manager.metricsKey(to), counters})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].from != samples[j].from {
+			return samples[i].from < samples[j].from
+		}
+		return samples[i].to < samples[j].to
+	})
+
+	w.Family("s12_route_messages_total", "Frames forwarded per route.", metrics.TypeCounter)
+	for _, s := range samples {
+		w.Sample("s12_route_messages_total", float64(s.counters.Messages()), "from", s.from, "to", s.to)
+	}
+	w.Family("s12_route_bytes_total", "Payload bytes forwarded per route.", metrics.TypeCounter)
+	for _, s := range samples {
+		w.Sample("s12_route_bytes_total", float64(s.counters.Bytes()), "from", s.from, "to", s.to)
+	}
+}
+
+// 设备key就是设备连接s12的凭证，/metrics不需要认证，默认只输出key的哈希
+// 同一个key每次得到的值相同，可以按key算出哈希来查对应的路由
+func (manager *ClientManager) metricsKey(key string) string {
+	if !manager.Config.MetricsRedact {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// 等待设备上线的路由
+// s10下发conn指令的时候，收发数据的设备不一定已经连上s12
+// 这时把路由记录在这里，等设备上线（Register）的时候再接上
+type pendingRoute struct {
+	From     string // 路由的发送方
+	To       string // 路由的接收方
+	WaitFrom bool   // true 表示在等发送方上线，false 表示在等接收方上线
+
+	onArrive func(client *Client)
+	timer    *time.Timer
+}
+
+// 等待的设备key
+func (r *pendingRoute) key() string {
+	if r.WaitFrom {
+		return r.From
+	}
+	return r.To
+}
+
+// 等待上线的路由表，键是等待上线的设备key
+type PendingRoutes struct {
+	lock   sync.Mutex
+	routes map[string][]*pendingRoute
+}
+
+func NewPendingRoutes() *PendingRoutes {
+	return &PendingRoutes{
+		routes: make(map[string][]*pendingRoute),
+	}
+}
+
+// 登记一条等待设备上线的路由
+// 设备上线时调用 onArrive，超过 timeout 还没上线则调用 onTimeout（只调用一次，路由继续等待）
+// timeout 为0表示不设超时
+func (p *PendingRoutes) Wait(from, to string, waitFrom bool, timeout time.Duration, onArrive func(client *Client), onTimeout func()) {
+	route := &pendingRoute{
+		From:     from,
+		To:       to,
+		WaitFrom: waitFrom,
+		onArrive: onArrive,
+	}
+	if timeout > 0 && onTimeout != nil {
+		route.timer = time.AfterFunc(timeout, onTimeout)
+	}
+
+	p.lock.Lock()
+	p.routes[route.key()] = append(p.routes[route.key()], route)
+	p.lock.Unlock()
+}
+
+// 设备上线，接上所有在等它的路由
+func (p *PendingRoutes) Notify(client *Client) {
+	p.lock.Lock()
+	routes := p.routes[client.Key]
+	delete(p.routes, client.Key)
+	p.lock.Unlock()
+
+	for _, route := range routes {
+		if route.timer != nil {
+			route.timer.Stop()
+		}
+		route.onArrive(client)
+	}
+}
+
+// 取消一条还在等待的路由，比如s10下发了disconn指令
+func (p *PendingRoutes) Cancel(from, to string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for key, routes := range p.routes {
+		kept := routes[:0]
+		for _, route := range routes {
+			if route.From == from && route.To == to && !route.WaitFrom {
+				if route.timer != nil {
+					route.timer.Stop()
+				}
+				continue
+			}
+			kept = append(kept, route)
+		}
+		if len(kept) == 0 {
+			delete(p.routes, key)
+		} else {
+			p.routes[key] = kept
+		}
+	}
+}
+
+// 取消在等from设备上线的路由，from已经没有任何路由的时候调用
+func (p *PendingRoutes) CancelFrom(from string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	routes := p.routes[from]
+	kept := routes[:0]
+	for _, route := range routes {
+		if route.WaitFrom {
+			if route.timer != nil {
+				route.timer.Stop()
+			}
+			continue
+		}
+		kept = append(kept, route)
+	}
+	if len(kept) == 0 {
+		delete(p.routes, from)
+	} else {
+		p.routes[from] = kept
+	}
+}
+
+// 当前在等待的路由数
+func (p *PendingRoutes) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	total := 0
+	for _, routes := range p.routes {
+		total += len(routes)
+	}
+	return total
+}
@@ -0,0 +1,58 @@
+package server
+
+import "sort"
+
+// 查询在线设备的条件，为空的字段不参与过滤
+type ClientFilter struct {
+	DeviceType string
+	Mac        string
+}
+
+func (f ClientFilter) match(client *Client) bool {
+	if f.DeviceType != "" && client.DeviceType != f.DeviceType {
+		return false
+	}
+	if f.Mac != "" && client.Mac != f.Mac {
+		return false
+	}
+	return true
+}
+
+// 按key查询在线设备的信息，同一个key有多个会话时返回最新的一个
+// 返回的是一份快照，不会持有管理器内部的任何锁
+func (manager *ClientManager) Get(key string) (ClientStatus, bool) {
+	client, ok := manager.Clients.Get(key)
+	if !ok {
+		return ClientStatus{}, false
+	}
+	return client.Status(), true
+}
+
+// 符合条件的在线设备，按key排序
+func (manager *ClientManager) List(filter ClientFilter) []ClientStatus {
+	var clients []*Client
+	switch {
+	case filter.Mac != "":
+		clients = manager.Clients.ByMac(filter.Mac)
+	case filter.DeviceType != "":
+		clients = manager.Clients.ByType(filter.DeviceType)
+	default:
+		clients = manager.Clients.All()
+	}
+
+	list := make([]ClientStatus, 0, len(clients))
+	for _, client := range clients {
+		if filter.match(client) {
+			list = append(list, client.Status())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// 每种类型的在线设备数
+func (manager *ClientManager) CountByType() map[string]int {
+	return manager.Clients.CountByType()
+}
@@ -0,0 +1,163 @@
+package server
+
+import "sync"
+
+// 在线设备的索引，可以并发使用
+// 按设备key索引，同时按DeviceType和Mac建立索引，查找都是O(1)
+// 同一个key允许有多个会话（由DuplicateKeyPolicy决定），按上线顺序保存
+type Registry struct {
+	lock   sync.RWMutex
+	byKey  map[string][]*Client
+	byType map[string]map[*Client]struct{}
+	byMac  map[string]map[*Client]struct{}
+	count  int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byKey:  make(map[string][]*Client),
+		byType: make(map[string]map[*Client]struct{}),
+		byMac:  make(map[string]map[*Client]struct{}),
+	}
+}
+
+// 加入一个设备会话
+func (r *Registry) Add(client *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.byKey[client.Key] = append(r.byKey[client.Key], client)
+	addIndex(r.byType, client.DeviceType, client)
+	if client.Mac != "" {
+		addIndex(r.byMac, client.Mac, client)
+	}
+	r.count++
+}
+
+// 删除一个设备会话，会话不存在时返回false
+func (r *Registry) Remove(client *Client) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sessions := r.byKey[client.Key]
+	for index, session := range sessions {
+		if session != client {
+			continue
+		}
+		if len(sessions) == 1 {
+			delete(r.byKey, client.Key)
+		} else {
+			r.byKey[client.Key] = append(sessions[:index:index], sessions[index+1:]...)
+		}
+		removeIndex(r.byType, client.DeviceType, client)
+		if client.Mac != "" {
+			removeIndex(r.byMac, client.Mac, client)
+		}
+		r.count--
+		return true
+	}
+	return false
+}
+
+// 找到key对应的设备，有多个会话时返回最新的一个
+func (r *Registry) Get(key string) (*Client, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	sessions := r.byKey[key]
+	if len(sessions) == 0 {
+		return nil, false
+	}
+	return sessions[len(sessions)-1], true
+}
+
+// key对应的所有会话，按上线顺序
+func (r *Registry) Sessions(key string) []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]*Client(nil), r.byKey[key]...)
+}
+
+// 某种类型的所有设备
+func (r *Registry) ByType(deviceType string) []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return indexed(r.byType[deviceType])
+}
+
+// 某个Mac地址的所有设备
+func (r *Registry) ByMac(mac string) []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return indexed(r.byMac[mac])
+}
+
+// 所有在线的设备会话
+func (r *Registry) All() []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	clients := make([]*Client, 0, r.count)
+	for _, sessions := range r.byKey {
+		clients = append(clients, sessions...)
+	}
+	return clients
+}
+
+// 会话是否还在线
+func (r *Registry) Contains(client *Client) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, session := range r.byKey[client.Key] {
+		if session == client {
+			return true
+		}
+	}
+	return false
+}
+
+// 在线的会话数
+func (r *Registry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.count
+}
+
+func addIndex(index map[string]map[*Client]struct{}, value string, client *Client) {
+	if index[value] == nil {
+		index[value] = make(map[*Client]struct{})
+	}
+	index[value][client] = struct{}{}
+}
+
+func removeIndex(index map[string]map[*Client]struct{}, value string, client *Client) {
+	delete(index[value], client)
+	if len(index[value]) == 0 {
+		delete(index, value)
+	}
+}
+
+func indexed(clients map[*Client]struct{}) []*Client {
+	list := make([]*Client, 0, len(clients))
+	for client := range clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+// 每种类型的在线设备数
+func (r *Registry) CountByType() map[string]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	counts := make(map[string]int, len(r.byType))
+	for deviceType, clients := range r.byType {
+		counts[deviceType] = len(clients)
+	}
+	return counts
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newTestClient(key, deviceType, mac string) *Client {
+	return &Client{
+		Key:        key,
+		DeviceType: deviceType,
+		Mac:        mac,
+		counters:   &clientCounters{},
+	}
+}
+
+func newTestManager(clients ...*Client) *ClientManager {
+	manager := &ClientManager{Clients: NewRegistry()}
+	for _, client := range clients {
+		manager.Clients.Add(client)
+	}
+	return manager
+}
+
+func keys(list []ClientStatus) []string {
+	result := []string{}
+	for _, status := range list {
+		result = append(result, status.Key)
+	}
+	return result
+}
+
+func TestGet(t *testing.T) {
+	old := newTestClient("a", "papp", "m1")
+	newer := newTestClient("a", "papp", "m2")
+	manager := newTestManager(old, newer, newTestClient("b", "s2", ""))
+
+	status, ok := manager.Get("a")
+	if !ok || status.Mac != "m2" {
+		t.Fatalf("Get(a) = %+v, %v, want the newest session", status, ok)
+	}
+	if _, ok := manager.Get("c"); ok {
+		t.Fatal("Get(c) found a device that is not online")
+	}
+
+	manager.Clients.Remove(newer)
+	status, ok = manager.Get("a")
+	if !ok || status.Mac != "m1" {
+		t.Fatalf("Get(a) after removing the newest session = %+v, %v", status, ok)
+	}
+}
+
+func TestList(t *testing.T) {
+	manager := newTestManager(
+		newTestClient("c", "papp", "m1"),
+		newTestClient("a", "papp", "m2"),
+		newTestClient("b", "s2", "m1"),
+		newTestClient("d", "s2", ""),
+	)
+
+	tests := []struct {
+		name   string
+		filter ClientFilter
+		want   []string
+	}{
+		{"all", ClientFilter{}, []string{"a", "b", "c", "d"}},
+		{"type", ClientFilter{DeviceType: "papp"}, []string{"a", "c"}},
+		{"mac", ClientFilter{Mac: "m1"}, []string{"b", "c"}},
+		{"type and mac", ClientFilter{DeviceType: "s2", Mac: "m1"}, []string{"b"}},
+		{"unknown type", ClientFilter{DeviceType: "winapp"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keys(manager.List(tt.filter)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List(%+v) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountByType(t *testing.T) {
+	b := newTestClient("b", "s2", "")
+	manager := newTestManager(newTestClient("a", "papp", ""), b, newTestClient("c", "s2", ""))
+
+	want := map[string]int{"papp": 1, "s2": 2}
+	if got := manager.CountByType(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("CountByType() = %v, want %v", got, want)
+	}
+
+	manager.Clients.Remove(b)
+	want = map[string]int{"papp": 1, "s2": 1}
+	if got := manager.CountByType(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("CountByType() after remove = %v, want %v", got, want)
+	}
+}
+
+// 设备上下线的同时并发查询，用 go test -race 运行
+func TestConcurrentLookup(t *testing.T) {
+	manager := newTestManager()
+	types := []string{"papp", "s2", "winapp"}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				client := newTestClient(fmt.Sprintf("key-%d", i%10), types[i%len(types)], fmt.Sprintf("mac-%d", w))
+				manager.Clients.Add(client)
+				manager.Clients.Remove(client)
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				manager.Get(fmt.Sprintf("key-%d", i%10))
+				manager.List(ClientFilter{DeviceType: types[i%len(types)]})
+				manager.List(ClientFilter{})
+				manager.CountByType()
+				manager.CheckClientExist("key-0")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := manager.Clients.Len(); n != 0 {
+		t.Fatalf("Len() = %d after every device went offline", n)
+	}
+	if counts := manager.CountByType(); len(counts) != 0 {
+		t.Fatalf("CountByType() = %v after every device went offline", counts)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"reflect"
+	"sanji_s12/commands"
+	"sanji_s12/config"
+	"testing"
+)
+
+// 建好a=b、a=c、d=e三条路由，设备都不在线，路由都在等设备上线
+func newResetManager(t *testing.T) *ClientManager {
+	manager := NewClientManager(config.Default())
+	for _, pair := range []RoutePair{{"a", "b"}, {"a", "c"}, {"d", "e"}} {
+		if err := manager.Connect(pair.From, pair.To, RouteOptions{}); err != nil {
+			t.Fatalf("Connect(%s, %s): %v", pair.From, pair.To, err)
+		}
+	}
+	return manager
+}
+
+func TestReset(t *testing.T) {
+	kept := func(from, to string) RouteResult {
+		return RouteResult{From: from, To: to, Action: RouteKept}
+	}
+	closed := func(from, to string) RouteResult {
+		return RouteResult{From: from, To: to, Action: RouteClosed}
+	}
+	missing := func(from, to string) RouteResult {
+		return RouteResult{From: from, To: to, Action: RouteMissing, Code: commands.CodeRouteUnknown, Msg: "route " + from + " -> " + to + " does not exist"}
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []RouteResult
+		duplex  []RoutePair // 另外建立的双向路由
+		routes  map[string][]string
+		errCode int
+	}{
+		{
+			name:   "keep some",
+			data:   "a=b,d=e",
+			want:   []RouteResult{kept("a", "b"), kept("d", "e"), closed("a", "c")},
+			routes: map[string][]string{"a": {"b"}, "d": {"e"}},
+		},
+		{
+			name:   "keep all",
+			data:   "d=e,a=c,a=b",
+			want:   []RouteResult{kept("d", "e"), kept("a", "c"), kept("a", "b")},
+			routes: map[string][]string{"a": {"b", "c"}, "d": {"e"}},
+		},
+		{
+			name:   "keep none",
+			data:   "",
+			want:   []RouteResult{closed("a", "b"), closed("a", "c"), closed("d", "e")},
+			routes: map[string][]string{},
+		},
+		{
+			name:   "unknown pair",
+			data:   "a=b,x=y",
+			want:   []RouteResult{kept("a", "b"), missing("x", "y"), closed("a", "c"), closed("d", "e")},
+			routes: map[string][]string{"a": {"b"}},
+		},
+		{
+			name:   "duplicate pair and spaces",
+			data:   " a=b , a=b ",
+			want:   []RouteResult{kept("a", "b"), closed("a", "c"), closed("d", "e")},
+			routes: map[string][]string{"a": {"b"}},
+		},
+		{
+			name:   "keep duplex by either direction",
+			data:   "y=x",
+			duplex: []RoutePair{{"x", "y"}},
+			want:   []RouteResult{kept("y", "x"), closed("a", "b"), closed("a", "c"), closed("d", "e")},
+			routes: map[string][]string{"x": {"y"}, "y": {"x"}},
+		},
+		{
+			name:   "close duplex as one route",
+			data:   "a=b",
+			duplex: []RoutePair{{"x", "y"}},
+			want:   []RouteResult{kept("a", "b"), closed("a", "c"), closed("d", "e"), closed("x", "y")},
+			routes: map[string][]string{"a": {"b"}},
+		},
+		{
+			name:    "missing separator",
+			data:    "a=b,d",
+			routes:  map[string][]string{"a": {"b", "c"}, "d": {"e"}},
+			errCode: commands.CodeBadData,
+		},
+		{
+			name:    "empty key",
+			data:    "a=",
+			routes:  map[string][]string{"a": {"b", "c"}, "d": {"e"}},
+			errCode: commands.CodeBadData,
+		},
+		{
+			name:    "too many keys",
+			data:    "a=b=c",
+			routes:  map[string][]string{"a": {"b", "c"}, "d": {"e"}},
+			errCode: commands.CodeBadData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newResetManager(t)
+			for _, pair := range tt.duplex {
+				if err := manager.Connect(pair.From, pair.To, RouteOptions{Duplex: true}); err != nil {
+					t.Fatalf("Connect(%s, %s, duplex): %v", pair.From, pair.To, err)
+				}
+			}
+
+			results, err := manager.Reset(tt.data)
+			if code, _ := commands.ErrorCode(err); code != tt.errCode {
+				t.Fatalf("Reset(%q) error = %v, want code %d", tt.data, err, tt.errCode)
+			}
+			if err == nil && !reflect.DeepEqual(results, tt.want) {
+				t.Errorf("Reset(%q) = %+v, want %+v", tt.data, results, tt.want)
+			}
+			if routes := manager.Router.Snapshot(); !reflect.DeepEqual(routes, tt.routes) {
+				t.Errorf("routes after Reset(%q) = %v, want %v", tt.data, routes, tt.routes)
+			}
+			for from := range manager.Router.Connections() {
+				if _, ok := tt.routes[from]; !ok {
+					t.Errorf("connection of %s is still there after its last route was closed", from)
+				}
+			}
+		})
+	}
+}
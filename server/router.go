@@ -0,0 +1,257 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// 路由器，保存所有的路由状态，可以并发使用
+// 包括：
+// 1 连接实例，键是fromKey
+// 2 路由表，键是需要读取数据的设备，值是需要接收数据的设备。
+// 路由表是一张有向图：一个设备可以发给多个设备，也可以同时接收多个设备的数据，
+// 所以同时按接收方保存一份反向的边，查找某个设备在接收谁的数据时不用遍历整张表
+// 因为s10发送指令的时候，accept, conn指令是同时发送的，
+// 所以有可能在s10还没收到accept指令的时候，就收到了conn指令，
+// 这时先往路由表中加入一条记录，如果收发数据的设备都在线的话，就开始转发数据
+// 双向路由由两条方向相反的边组成，同时建立、同时删除，上报时算作一条
+// 广播单独保存在 BroadcastSessions 中
+type Router struct {
+	lock        sync.RWMutex
+	connections map[string]*Connection
+	routes      map[string][]string // from -> to
+	sources     map[string][]string // to -> from，与routes同步
+	duplex      map[RoutePair]bool  // 双向路由，键是建立时的方向
+}
+
+func NewRouter() *Router {
+	return &Router{
+		connections: make(map[string]*Connection),
+		routes:      make(map[string][]string),
+		sources:     make(map[string][]string),
+		duplex:      make(map[RoutePair]bool),
+	}
+}
+
+// 加入一条路由，路由已经存在时返回false
+func (r *Router) AddRoute(from, to string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, key := range r.routes[from] {
+		if key == to {
+			return false
+		}
+	}
+	r.routes[from] = append(r.routes[from], to)
+	r.sources[to] = append(r.sources[to], from)
+	return true
+}
+
+// 加入一条双向路由，任何一个方向已经存在时返回false，什么都不加
+func (r *Router) AddDuplex(from, to string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.hasRoute(from, to) || r.hasRoute(to, from) {
+		return false
+	}
+	r.routes[from] = append(r.routes[from], to)
+	r.sources[to] = append(r.sources[to], from)
+	r.routes[to] = append(r.routes[to], from)
+	r.sources[from] = append(r.sources[from], to)
+	r.duplex[RoutePair{From: from, To: to}] = true
+	return true
+}
+
+// 删除一条路由，路由不存在时返回false
+// 双向路由的两个方向一起删除
+func (r *Router) RemoveRoute(from, to string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !removeEdge(r.routes, from, to) {
+		return false
+	}
+	removeEdge(r.sources, to, from)
+
+	if partner, ok := r.partner(from, to); ok {
+		removeEdge(r.routes, partner.From, partner.To)
+		removeEdge(r.sources, partner.To, partner.From)
+		delete(r.duplex, RoutePair{From: from, To: to})
+		delete(r.duplex, partner)
+	}
+	return true
+}
+
+// 双向路由中与from->to方向相反的那一条
+func (r *Router) Partner(from, to string) (RoutePair, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.partner(from, to)
+}
+
+func (r *Router) partner(from, to string) (RoutePair, bool) {
+	reverse := RoutePair{From: to, To: from}
+	if r.duplex[RoutePair{From: from, To: to}] || r.duplex[reverse] {
+		return reverse, true
+	}
+	return RoutePair{}, false
+}
+
+// 从table[key]中删除value
+func removeEdge(table map[string][]string, key, value string) bool {
+	keys := table[key]
+	for index, item := range keys {
+		if item == value {
+			// 重新分配切片，避免影响已经返回出去的快照
+			remain := make([]string, 0, len(keys)-1)
+			remain = append(remain, keys[:index]...)
+			remain = append(remain, keys[index+1:]...)
+			if len(remain) == 0 {
+				delete(table, key)
+			} else {
+				table[key] = remain
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// 路由是否存在
+func (r *Router) HasRoute(from, to string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.hasRoute(from, to)
+}
+
+func (r *Router) hasRoute(from, to string) bool {
+	for _, key := range r.routes[from] {
+		if key == to {
+			return true
+		}
+	}
+	return false
+}
+
+// from设备的数据要发给哪些设备
+func (r *Router) RoutesFrom(from string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]string(nil), r.routes[from]...)
+}
+
+// to设备在接收哪些设备的数据
+func (r *Router) RoutesTo(to string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]string(nil), r.sources[to]...)
+}
+
+// 路由表的拷贝，用于上报和打印
+func (r *Router) Snapshot() map[string][]string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return copyTable(r.routes)
+}
+
+// 按上报的格式整理路由表：双向路由只保留建立时的方向，另外在duplex中列出
+func (r *Router) Tables() (routes map[string][]string, duplex map[string][]string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	routes = make(map[string][]string, len(r.routes))
+	duplex = make(map[string][]string)
+	for from, keys := range r.routes {
+		for _, to := range keys {
+			if r.duplex[RoutePair{From: to, To: from}] {
+				continue
+			}
+			routes[from] = append(routes[from], to)
+			if r.duplex[RoutePair{From: from, To: to}] {
+				duplex[from] = append(duplex[from], to)
+			}
+		}
+	}
+	return routes, duplex
+}
+
+// 所有路由，双向路由只算一条，按from、to排序
+func (r *Router) Pairs() []RoutePair {
+	routes, _ := r.Tables()
+
+	var pairs []RoutePair
+	for from, keys := range routes {
+		for _, to := range keys {
+			pairs = append(pairs, RoutePair{From: from, To: to})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].From != pairs[j].From {
+			return pairs[i].From < pairs[j].From
+		}
+		return pairs[i].To < pairs[j].To
+	})
+	return pairs
+}
+
+// 找到from设备的连接实例
+func (r *Router) Connection(from string) (*Connection, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	conn, ok := r.connections[from]
+	return conn, ok
+}
+
+// 保存from设备的连接实例
+func (r *Router) SetConnection(from string, conn *Connection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.connections[from] = conn
+}
+
+// 删除from设备的连接实例，返回被删除的实例
+func (r *Router) RemoveConnection(from string) (*Connection, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	conn, ok := r.connections[from]
+	delete(r.connections, from)
+	return conn, ok
+}
+
+// 所有连接实例的拷贝
+func (r *Router) Connections() map[string]*Connection {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	conns := make(map[string]*Connection, len(r.connections))
+	for from, conn := range r.connections {
+		conns[from] = conn
+	}
+	return conns
+}
+
+// 连接实例的数量
+func (r *Router) ConnectionCount() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.connections)
+}
+
+func copyTable(table map[string][]string) map[string][]string {
+	snapshot := make(map[string][]string, len(table))
+	for from, keys := range table {
+		snapshot[from] = append([]string(nil), keys...)
+	}
+	return snapshot
+}
@@ -1,27 +1,20 @@
 package server
 
 import (
-	"fmt"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"net/url"
 	"sanji_s12/commands"
+	"sanji_s12/logger"
 )
 
-// ClientManager实例化，全局变量
-// 考虑将ClientManager移到公共包中
-var Manager = ClientManager{
-	Broadcast:  make(chan []byte),
-	Register:   make(chan *Client),
-	Unregister: make(chan *Client),
-	Clients:    make(map[*Client]bool),
-}
-
-// client连接的url格式：ws://192.168.1.186:9911/?devicetype=papp&key=faghjag
+// client连接的url格式：ws://192.168.1.186:9911/?devicetype=papp&key=faghjag&mac=xx:xx:xx:xx:xx:xx
 // 处理ws连接
-func WSServer(res http.ResponseWriter, req *http.Request) {
-
-	fmt.Println("execute here")
+func (manager *ClientManager) WSServer(res http.ResponseWriter, req *http.Request) {
+	if manager.IsClosing() {
+		http.Error(res, "s12 is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
 	conn, err := (&websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}).Upgrade(res, req, nil)
 	if err != nil {
@@ -46,7 +39,7 @@ func WSServer(res http.ResponseWriter, req *http.Request) {
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("field device_type is null"))
 		closeErr := conn.Close()
 		if closeErr != nil {
-			fmt.Println(closeErr)
+			logger.Debug("can't close rejected connection", logger.Err(closeErr))
 		}
 		return
 	}
@@ -59,53 +52,51 @@ func WSServer(res http.ResponseWriter, req *http.Request) {
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("field key is null"))
 		closeErr := conn.Close()
 		if closeErr != nil {
-			fmt.Println(closeErr)
+			logger.Debug("can't close rejected connection", logger.Err(closeErr))
 		}
 		return
 	}
 
-	for _, key := range commands.PermissionKey {
-		fmt.Println("permit key: ", key)
+	//提取 url中 mac，可以不带
+	if len(queryForm["mac"]) != 0 {
+		mac = queryForm["mac"][0]
 	}
 
-	fmt.Println("url key: ", key)
-
 	// 如果key在permissionKey中，则让设备进行连接
-	exist = false
-	for _, pKey := range commands.PermissionKey {
-		if key == pKey {
-			exist = true
-		}
-	}
+	exist = commands.KeyAllowed(key)
 
 	// 在permissionKey中没有找到
 	if !exist {
+		logger.Warn("permission denied", logger.Key(key), logger.F("devicetype", reqType), logger.F("addr", req.RemoteAddr))
+		manager.metrics.rejections.Inc(RejectPermission)
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("Permission deny"))
 		closeErr := conn.Close()
 		if closeErr != nil {
-			fmt.Println(closeErr)
+			logger.Debug("can't close rejected connection", logger.Err(closeErr))
 		}
 		return
 	}
 
 	// 实例化这个设备
 	client := &Client{
-		DeviceType:    reqType,
-		Key:           key,
-		Mac:           mac,
-		Socket:        conn,
-		IP:            ip,
-		Read:          make(chan []byte),
-		Write:         make(chan []byte),
-		CloseChan:     make(chan struct{}, 1),
-		BroadcastRecv: false,
+		DeviceType:  reqType,
+		Key:         key,
+		Mac:         mac,
+		Socket:      conn,
+		IP:          ip,
+		Read:        make(chan Frame, manager.Config.ClientReadBuffer),
+		Write:       make(chan Frame, manager.Config.ClientWriteBuffer),
+		CloseChan:   make(chan struct{}, 1),
+		WritePolicy: manager.Config.WritePolicyFor(reqType),
+		manager:     manager,
+		counters:    &clientCounters{},
 	}
 
 	//util.SmartPrint(client)
 
-	Manager.Register <- client
+	manager.Register <- client
 	//
-	//for c, _ := range Manager.Clients {
+	//for c, _ := range manager.Clients {
 	//	fmt.Println(c)
 	//}
 
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"sanji_s12/commands"
+	"sanji_s12/logger"
+	"sanji_s12/util"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 是否正在关闭
+func (manager *ClientManager) IsClosing() bool {
+	return atomic.LoadInt32(&manager.closing) == 1
+}
+
+// 关闭s12的服务端
+// 1 不再接受新的设备连接
+// 2 告知s10 s12要下线了
+// 3 停止所有转发数据的协程
+// 4 向每个设备发送带原因的关闭帧，然后断开
+// 所有设备同时关闭，不读数据的设备最多等WriteWait，并且最多用掉ctx剩下时间的一半，留一半给s10
+func (manager *ClientManager) Shutdown(ctx context.Context, reason string) {
+	if !atomic.CompareAndSwapInt32(&manager.closing, 0, 1) {
+		return
+	}
+
+	commands.OutCmdQueue.Push(commands.Cmd{
+		CmdId: util.GetCmdId(),
+		Cmd:   "shutdown",
+		Role:  "client",
+		Data:  reason,
+	})
+
+	for fromKey := range manager.Router.Connections() {
+		if conn, ok := manager.Router.RemoveConnection(fromKey); ok {
+			conn.Stop()
+		}
+	}
+
+	clients := manager.Clients.All()
+
+	deadline := time.Now().Add(manager.Config.WriteWait.Duration)
+	if d, ok := ctx.Deadline(); ok {
+		if half := time.Now().Add(time.Until(d) / 2); half.Before(deadline) {
+			deadline = half
+		}
+	}
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			client.closeBefore(websocket.CloseGoingAway, reason, deadline)
+		}(client)
+	}
+	wg.Wait()
+	logger.Info("devices closed", logger.F("count", len(clients)))
+}
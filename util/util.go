@@ -1,25 +1,22 @@
 package util
 
 import (
-	"fmt"
 	"reflect"
+	"sanji_s12/logger"
 	"sync/atomic"
 )
 
+// 以debug级别把结构体的每个字段打到日志中
 func SmartPrint(i interface{}){
-	var kv = make(map[string]interface{})
 	vValue := reflect.ValueOf(i)
 	vType :=reflect.TypeOf(i)
+	var fields []logger.Field
 	for i:=0; i < vValue.NumField(); i++{
-		kv[vType.Field(i).Name] = vValue.Field(i)
-	}
-	fmt.Println("获取到数据:")
-	for k,v := range kv {
-		fmt.Print(k)
-		fmt.Print(":")
-		fmt.Print(v)
-		fmt.Println()
+		if vValue.Field(i).CanInterface() {
+			fields = append(fields, logger.F(vType.Field(i).Name, vValue.Field(i).Interface()))
+		}
 	}
+	logger.Debug("获取到数据", fields...)
 }
 
 // cmdId 最大值，超出最大值则重置 1,000,000,000